@@ -4,24 +4,44 @@ import (
 	"flag"
 	"time"
 
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	kubeinformers "k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog"
 
 	"github.com/zduymz/elb-inject/pkg/apis/elb-inject"
+	"github.com/zduymz/elb-inject/pkg/configfile"
 	ctlr "github.com/zduymz/elb-inject/pkg/controller"
 	//clientset "k8s.io/sample-controller/pkg/generated/clientset/versioned"
 	//informers "k8s.io/sample-controller/pkg/generated/informers/externalversions"
 	"github.com/zduymz/elb-inject/pkg/signals"
+	"github.com/zduymz/elb-inject/pkg/utils"
 )
 
-var config elb_inject.Config
+// how often the config file is checked for changes
+const configReloadInterval = 10 * time.Second
+
+var (
+	config     elb_inject.Config
+	configFile string
+)
 
 func main() {
 	klog.InitFlags(nil)
 	flag.Parse()
 
+	// the file wins over flags, flags are the defaults of a reload
+	flagConfig := configfile.Clone(&config)
+	if configFile != "" {
+		if err := configfile.Load(configFile, &config); err != nil {
+			klog.Fatalf("Error loading config file: %s", err.Error())
+		}
+	}
+	if err := configfile.Validate(&config); err != nil {
+		klog.Fatalf("Error validating config: %s", err.Error())
+	}
+
 	// set up signals so we handle the first shutdown signal gracefully
 	stopCh := signals.SetupSignalHandler()
 
@@ -35,14 +55,39 @@ func main() {
 		klog.Fatalf("Error building kubernetes clientset: %s", err.Error())
 	}
 
+	// filter pods at the informer level, so we don't keep every pod in memory
+	podInformerOptions := []kubeinformers.SharedInformerOption{
+		kubeinformers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = config.PodSelector
+		}),
+	}
+	if len(config.IncludeNamespaces) == 1 {
+		podInformerOptions = append(podInformerOptions, kubeinformers.WithNamespace(config.IncludeNamespaces[0]))
+	}
+
 	// (client kubernetes.Interface, defaultResync time.Duration)
+	podInformerFactory := kubeinformers.NewSharedInformerFactoryWithOptions(kubeClient, time.Second*30, podInformerOptions...)
 	kubeInformerFactory := kubeinformers.NewSharedInformerFactory(kubeClient, time.Second*30)
 
-	controller, err := ctlr.NewController(kubeInformerFactory.Core().V1().Pods(), kubeClient, &config)
+	controller, err := ctlr.NewController(podInformerFactory.Core().V1().Pods(), kubeInformerFactory.Core().V1().Namespaces(), kubeInformerFactory.Policy().V1beta1().PodDisruptionBudgets(), kubeClient, &config)
 	if err != nil {
 		klog.Fatalf("Error building kubernetes controller: %s", err.Error())
 	}
 
+	if configFile != "" {
+		go configfile.Watch(configFile, configReloadInterval, stopCh, func(data []byte) {
+			next := configfile.Clone(flagConfig)
+			if err := configfile.Parse(data, next); err != nil {
+				klog.Errorf("[Config] keeping the current config: %v", err)
+				return
+			}
+			if err := controller.Reload(next); err != nil {
+				klog.Errorf("[Config] keeping the current config: %v", err)
+			}
+		})
+	}
+
+	podInformerFactory.Start(stopCh)
 	kubeInformerFactory.Start(stopCh)
 
 	if err = controller.Run(1, stopCh); err != nil {
@@ -51,11 +96,60 @@ func main() {
 }
 
 func init() {
+	flag.StringVar(&configFile, "config", "", "yaml or json config file, overrides flags and is reloaded on change")
 	flag.StringVar(&config.KubeConfig, "kubeconfig", "", "kubeconfig")
 	flag.StringVar(&config.Master, "master", "", "master url")
 	flag.StringVar(&config.AWSRegion, "aws.region", "us-west-2", "aws region")
 	flag.IntVar(&config.APIRetries, "aws.retries", 3, "aws api call retries")
+	flag.DurationVar(&config.RequestTimeout.Duration, "aws.request-timeout", 30*time.Second, "timeout of a single aws api request")
+	flag.DurationVar(&config.TargetGroupRefreshInterval.Duration, "aws.target-group-refresh-interval", time.Minute, "how often the target groups are described, an unknown one is looked up right away")
 	flag.StringVar(&config.AWSAssumeRole, "aws.role", "", "aws assume role")
 	flag.StringVar(&config.AWSCredsFile, "aws.creds", "", "aws creds")
+	flag.StringVar(&config.AWSVPCId, "aws.vpc-id", "", "aws vpc id of the cluster, discovered from ec2 metadata when empty")
+	flag.BoolVar(&config.AWSAllowOutsideVPC, "aws.allow-outside-vpc", false, "register pod ip outside of the vpc subnets with AvailabilityZone all")
+	flag.BoolVar(&config.DryRun, "dry-run", false, "process pods but make no aws changes and no pod writes, only log and count them")
+	config.ExcludeNamespaces = append([]string(nil), ctlr.DefaultExcludeNamespaces...)
+	flag.Var((*utils.StringSlice)(&config.IncludeNamespaces), "namespaces.include", "comma separated namespaces to watch, all when empty")
+	flag.Var((*utils.StringSlice)(&config.ExcludeNamespaces), "namespaces.exclude", "comma separated namespaces to ignore")
+	flag.StringVar(&config.NamespaceSelector, "namespaces.selector", "", "only watch namespaces matching this label selector, e.g. elb-inject=enabled")
+	flag.StringVar(&config.PodSelector, "pods.selector", "", "only watch pods matching this label selector")
+	flag.StringVar(&config.AnnotationPrefix, "annotations.prefix", ctlr.DefaultAnnotationPrefix, "prefix of the pod annotations and readiness gate")
+	flag.Var((*utils.StringSlice)(&config.LegacyAnnotationPrefixes), "annotations.legacy-prefixes", "comma separated prefixes still read from pods annotated before a prefix change")
+	flag.StringVar(&config.ClusterName, "cluster-name", "", "only use target groups tagged elb-inject/cluster=<name>")
+	flag.BoolVar(&config.ClaimTargetGroups, "cluster.claim-target-groups", false, "tag unclaimed target groups with the cluster name on first use")
+	flag.BoolVar(&config.AllowForeignTargetGroups, "cluster.allow-foreign-target-groups", false, "use target groups claimed by another cluster")
+	flag.BoolVar(&config.HostNetworkConflictCheck, "host-network.conflict-check", false, "refuse to register a hostNetwork pod when another one on the same node already registered to the target group")
 	flag.StringVar(&config.SlackWebHook, "slack", "", "slack incoming webhook")
+	flag.StringVar(&config.SlackSigningSecretFile, "slack.signing-secret-file", "", "file with the slack app signing secret, enables the retry button callback")
+	flag.StringVar(&config.SlackListenAddress, "slack.listen-address", "", "listen address of the slack retry button callback /slack/actions, nothing else is served there (disabled when empty)")
+	flag.DurationVar(&config.NotifyAggregateWindow.Duration, "notify.aggregate-window", 30*time.Second, "send failures of the same type, target group and reason within this window as one message (disabled when 0)")
+	flag.StringVar(&config.HTTPListenAddress, "http.listen-address", "127.0.0.1:8080", "health, metrics and debug endpoints listen address, /ledger and /dry-run are not authenticated (disabled when empty)")
+	flag.StringVar(&config.LedgerNamespace, "ledger.namespace", "default", "namespace of the ledger configmap")
+	flag.StringVar(&config.LedgerName, "ledger.name", "elb-inject-ledger", "name of the ledger configmap")
+	flag.DurationVar(&config.LedgerGCInterval.Duration, "ledger.gc-interval", 5*time.Minute, "how often ledger entries of deleted pods are deregistered")
+	flag.StringVar(&config.PolicyNamespace, "policy.namespace", "default", "namespace of the policy configmap")
+	flag.StringVar(&config.PolicyName, "policy.name", "", "name of the policy configmap (disabled when empty)")
+	flag.DurationVar(&config.GCInterval.Duration, "gc.interval", 0, "how often orphaned targets are garbage collected (disabled when 0)")
+	flag.DurationVar(&config.GCGracePeriod.Duration, "gc.grace-period", 10*time.Minute, "how long a target stays orphaned before it is deregistered")
+	flag.IntVar(&config.GCMaxDeletions, "gc.max-deletions", 10, "maximum deregistrations per gc cycle")
+	flag.BoolVar(&config.GCReportOnly, "gc.report-only", true, "only log what gc would deregister")
+	flag.Var((*utils.StringSlice)(&config.GCPodCIDRs), "gc.pod-cidrs", "comma separated pod cidrs, only targets in them are garbage collected")
+	flag.StringVar(&config.GCTargetGroupTag, "gc.target-group-tag", "elb-inject/managed=true", "only target groups with this tag are garbage collected")
+	flag.DurationVar(&config.AlertInterval.Duration, "alert.interval", time.Minute, "how often stuck pods and unhealthy targets are checked (disabled when 0)")
+	flag.DurationVar(&config.AlertStuckAfter.Duration, "alert.stuck-after", 10*time.Minute, "alert on a running pod not registered after this long")
+	flag.DurationVar(&config.AlertUnhealthyAfter.Duration, "alert.unhealthy-after", 5*time.Minute, "alert on a target still unhealthy this long after its registration")
+	flag.IntVar(&config.AlertRegisterFailures, "alert.register-failures", 5, "alert after this many consecutive register failures of a pod")
+	flag.DurationVar(&config.AlertDedupWindow.Duration, "alert.dedup-window", time.Hour, "send a similar alert (type, namespace, target group) once in this window")
+	flag.DurationVar(&config.DeregisterMaxBackoff.Duration, "deregister.max-backoff", 5*time.Minute, "longest wait between two attempts of a failed deregistration")
+	flag.IntVar(&config.DeregisterAlertAttempts, "deregister.alert-attempts", 5, "notify after this many failed attempts of a deregistration")
+	flag.DurationVar(&config.DeregisterAlertAfter.Duration, "deregister.alert-after", 5*time.Minute, "notify a deregistration still failing this long after its first attempt (disabled when 0)")
+	flag.DurationVar(&config.MinHealthyMaxDelay.Duration, "deregister.min-healthy-max-delay", 10*time.Minute, "longest delay of a voluntary deregistration keeping the minimum healthy targets (no limit when 0)")
+	flag.DurationVar(&config.HealthInterval.Duration, "health.interval", 30*time.Second, "how often the health of registered targets is polled (disabled when 0)")
+	flag.StringVar(&config.HealthReport, "health.report", "annotation", "where the target health of a pod is written: annotation, condition or both")
+	flag.DurationVar(&config.RemediationUnhealthyAfter.Duration, "remediation.unhealthy-after", 10*time.Minute, "quarantine or evict a pod which opted in when a target stays unhealthy this long (disabled when 0)")
+	flag.StringVar(&config.WebhookListenAddress, "webhook.listen-address", "", "admission webhook listen address, e.g. :8443 (disabled when empty)")
+	flag.StringVar(&config.WebhookCertFile, "webhook.tls-cert", "/etc/elb-inject/tls.crt", "admission webhook tls certificate")
+	flag.StringVar(&config.WebhookKeyFile, "webhook.tls-key", "/etc/elb-inject/tls.key", "admission webhook tls private key")
+	flag.BoolVar(&config.WebhookPreStopHook, "webhook.prestop-hook", false, "add a preStop sleep matching the target group deregistration delay to pods opted in with the prestop-hook annotation")
+	flag.StringVar(&config.WebhookValidationMode, "webhook.validation-mode", "reject", "what to do with an invalid pod: reject or warn")
 }
@@ -1,18 +1,124 @@
 package elb_inject
 
-import "time"
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
+	"github.com/zduymz/elb-inject/pkg/notify"
+	"github.com/zduymz/elb-inject/pkg/policy"
+)
+
+// Config can be loaded from a yaml/json file. Fields tagged reload:"true" are
+// picked up when the file changes, the others need a restart.
 type Config struct {
-	Master         string
-	RequestTimeout time.Duration
-	AWSAssumeRole  string
-	AWSRegion      string
-	AWSVPCId       string
-	APIRetries     int
-	SlackWebHook   string
+	Master         string          `json:"master,omitempty"`
+	RequestTimeout metav1.Duration `json:"requestTimeout,omitempty"`
+	AWSAssumeRole  string          `json:"awsAssumeRole,omitempty"`
+	AWSRegion      string          `json:"awsRegion,omitempty"`
+	AWSVPCId       string          `json:"awsVPCId,omitempty"`
+	// register pod ip outside of the vpc subnets with AvailabilityZone all
+	AWSAllowOutsideVPC bool `json:"awsAllowOutsideVPC,omitempty"`
+	APIRetries         int  `json:"apiRetries,omitempty"`
+	// how often the target groups are described, an unknown one is looked up right away
+	TargetGroupRefreshInterval metav1.Duration `json:"targetGroupRefreshInterval,omitempty"`
+	// shortcut for a slack notifier getting every event
+	SlackWebHook string `json:"slackWebHook,omitempty" reload:"true"`
+	// signing secret of the slack app, enables the /slack/actions endpoint of interactive notifiers
+	SlackSigningSecretFile string `json:"slackSigningSecretFile,omitempty" reload:"true"`
+	// serves /slack/actions only, disabled when empty
+	SlackListenAddress string `json:"slackListenAddress,omitempty"`
+	// where failures are sent
+	Notifiers []notify.Config `json:"notifiers,omitempty" reload:"true"`
+	// events of the same type, target group and reason within this window are sent as one
+	NotifyAggregateWindow metav1.Duration `json:"notifyAggregateWindow,omitempty" reload:"true"`
+	// process pods but only log and count the AWS and pod writes
+	DryRun bool `json:"dryRun,omitempty"`
+
+	// which pods are watched, IncludeNamespaces empty means all
+	IncludeNamespaces []string `json:"includeNamespaces,omitempty"`
+	ExcludeNamespaces []string `json:"excludeNamespaces,omitempty" reload:"true"`
+	// label selectors, e.g. elb-inject=enabled
+	NamespaceSelector string `json:"namespaceSelector,omitempty" reload:"true"`
+	PodSelector       string `json:"podSelector,omitempty"`
+
+	// prefix of the annotations and the readiness gate, e.g. example.com
+	AnnotationPrefix string `json:"annotationPrefix,omitempty"`
+	// keys under these prefixes are still read while pods migrate
+	LegacyAnnotationPrefixes []string `json:"legacyAnnotationPrefixes,omitempty"`
+
+	// only use target groups tagged elb-inject/cluster=ClusterName, skipped when empty
+	ClusterName string `json:"clusterName,omitempty"`
+	// tag unclaimed target groups with ClusterName on first use
+	ClaimTargetGroups bool `json:"claimTargetGroups,omitempty"`
+	// use target groups claimed by another cluster
+	AllowForeignTargetGroups bool `json:"allowForeignTargetGroups,omitempty"`
+
+	// refuse to register a hostNetwork pod when another hostNetwork pod on the
+	// same node already registered the node ip to the target group
+	HostNetworkConflictCheck bool `json:"hostNetworkConflictCheck,omitempty" reload:"true"`
+
+	// health and debug endpoints, disabled when empty
+	HTTPListenAddress string `json:"httpListenAddress,omitempty"`
+
+	// ConfigMap keeping every registration
+	LedgerNamespace  string          `json:"ledgerNamespace,omitempty"`
+	LedgerName       string          `json:"ledgerName,omitempty"`
+	LedgerGCInterval metav1.Duration `json:"ledgerGCInterval,omitempty"`
+
+	// ConfigMap mapping namespaces and service accounts to target groups they
+	// may use, disabled when PolicyName is empty
+	PolicyNamespace string `json:"policyNamespace,omitempty"`
+	PolicyName      string `json:"policyName,omitempty"`
+	// used when there is no policy ConfigMap
+	Policy *policy.Policy `json:"policy,omitempty" reload:"true"`
+
+	// Orphaned target GC, disabled when GCInterval is 0
+	GCInterval     metav1.Duration `json:"gcInterval,omitempty"`
+	GCGracePeriod  metav1.Duration `json:"gcGracePeriod,omitempty" reload:"true"`
+	GCMaxDeletions int             `json:"gcMaxDeletions,omitempty" reload:"true"`
+	GCReportOnly   bool            `json:"gcReportOnly" reload:"true"`
+	// only targets in these cidrs are garbage collected
+	GCPodCIDRs []string `json:"gcPodCIDRs,omitempty" reload:"true"`
+	// only target groups tagged key=value are garbage collected
+	GCTargetGroupTag string `json:"gcTargetGroupTag,omitempty" reload:"true"`
+
+	// Alert checks, stuck pods and unhealthy targets are not checked when AlertInterval is 0
+	AlertInterval metav1.Duration `json:"alertInterval,omitempty"`
+	// a running pod not registered after this long
+	AlertStuckAfter metav1.Duration `json:"alertStuckAfter,omitempty" reload:"true"`
+	// a target still unhealthy this long after its registration
+	AlertUnhealthyAfter metav1.Duration `json:"alertUnhealthyAfter,omitempty" reload:"true"`
+	// consecutive register failures of a pod before alerting
+	AlertRegisterFailures int `json:"alertRegisterFailures,omitempty" reload:"true"`
+	// a similar alert (type, namespace, target group) is sent once in this window
+	AlertDedupWindow metav1.Duration `json:"alertDedupWindow,omitempty" reload:"true"`
+
+	// Failed deregistrations are retried with a backoff up to DeregisterMaxBackoff
+	DeregisterMaxBackoff metav1.Duration `json:"deregisterMaxBackoff,omitempty"`
+	// failed attempts of a deregistration before notifying
+	DeregisterAlertAttempts int `json:"deregisterAlertAttempts,omitempty" reload:"true"`
+	// notify a deregistration still failing this long after its first attempt, only attempts count when 0
+	DeregisterAlertAfter metav1.Duration `json:"deregisterAlertAfter,omitempty" reload:"true"`
+	// longest delay of a voluntary deregistration by the minimum healthy targets guard, no limit when 0
+	MinHealthyMaxDelay metav1.Duration `json:"minHealthyMaxDelay,omitempty" reload:"true"`
+
+	// Target health watcher, disabled when HealthInterval is 0
+	HealthInterval metav1.Duration `json:"healthInterval,omitempty"`
+	// where the health of a pod targets is written: annotation, condition or both
+	HealthReport string `json:"healthReport,omitempty" reload:"true"`
+	// remediate a pod which opted in when a target stays unhealthy this long, its annotation may override it. Disabled when 0
+	RemediationUnhealthyAfter metav1.Duration `json:"remediationUnhealthyAfter,omitempty" reload:"true"`
+
+	// Admission webhook, disabled when WebhookListenAddress is empty
+	WebhookListenAddress string `json:"webhookListenAddress,omitempty"`
+	WebhookCertFile      string `json:"webhookCertFile,omitempty"`
+	WebhookKeyFile       string `json:"webhookKeyFile,omitempty"`
+	// reject or warn
+	WebhookValidationMode string `json:"webhookValidationMode,omitempty" reload:"true"`
+	// add a preStop sleep matching the target group deregistration delay to
+	// pods opted in with the prestop-hook annotation
+	WebhookPreStopHook bool `json:"webhookPreStopHook,omitempty" reload:"true"`
 
 	// Just use for testing purpse
-	AWSCredsFile   string
-	KubeConfig     string
+	AWSCredsFile string `json:"awsCredsFile,omitempty"`
+	KubeConfig   string `json:"kubeConfig,omitempty"`
 }
-
@@ -0,0 +1,211 @@
+package configfile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+
+	"github.com/zduymz/elb-inject/pkg/apis/elb-inject"
+	"github.com/zduymz/elb-inject/pkg/notify"
+)
+
+// Load reads a yaml or json file on top of config, settings missing from
+// the file keep the value they got from flags
+func Load(path string, config *elb_inject.Config) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return Parse(data, config)
+}
+
+// Parse decodes data on top of config, unknown keys are an error
+func Parse(data []byte, config *elb_inject.Config) error {
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+	return nil
+}
+
+// Validate checks settings which would otherwise only fail when used
+func Validate(config *elb_inject.Config) error {
+	switch config.WebhookValidationMode {
+	case "reject", "warn":
+	default:
+		return fmt.Errorf("webhookValidationMode: unknown mode %q, expected reject or warn", config.WebhookValidationMode)
+	}
+
+	switch config.HealthReport {
+	case "annotation", "condition", "both":
+	default:
+		return fmt.Errorf("healthReport: unknown value %q, expected annotation, condition or both", config.HealthReport)
+	}
+
+	if _, err := labels.Parse(config.NamespaceSelector); err != nil {
+		return fmt.Errorf("namespaceSelector: %v", err)
+	}
+	if _, err := labels.Parse(config.PodSelector); err != nil {
+		return fmt.Errorf("podSelector: %v", err)
+	}
+
+	for _, prefix := range append([]string{config.AnnotationPrefix}, config.LegacyAnnotationPrefixes...) {
+		if errs := validation.IsDNS1123Subdomain(prefix); len(errs) > 0 {
+			return fmt.Errorf("annotationPrefix: %q: %s", prefix, strings.Join(errs, ", "))
+		}
+	}
+
+	for _, cidr := range config.GCPodCIDRs {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("gcPodCIDRs: %v", err)
+		}
+	}
+
+	if config.GCTargetGroupTag == "" || strings.HasPrefix(config.GCTargetGroupTag, "=") {
+		return fmt.Errorf("gcTargetGroupTag: expected key or key=value, got %q", config.GCTargetGroupTag)
+	}
+
+	durations := map[string]time.Duration{
+		"requestTimeout": config.RequestTimeout.Duration,
+		"gcInterval":     config.GCInterval.Duration,
+		"gcGracePeriod":  config.GCGracePeriod.Duration,
+
+		"notifyAggregateWindow": config.NotifyAggregateWindow.Duration,
+
+		"alertInterval":       config.AlertInterval.Duration,
+		"alertStuckAfter":     config.AlertStuckAfter.Duration,
+		"alertUnhealthyAfter": config.AlertUnhealthyAfter.Duration,
+		"alertDedupWindow":    config.AlertDedupWindow.Duration,
+
+		"healthInterval":            config.HealthInterval.Duration,
+		"remediationUnhealthyAfter": config.RemediationUnhealthyAfter.Duration,
+
+		"deregisterAlertAfter": config.DeregisterAlertAfter.Duration,
+		"minHealthyMaxDelay":   config.MinHealthyMaxDelay.Duration,
+	}
+	for name, d := range durations {
+		if d < 0 {
+			return fmt.Errorf("%s: must not be negative", name)
+		}
+	}
+	if config.LedgerGCInterval.Duration <= 0 {
+		return fmt.Errorf("ledgerGCInterval: must be positive")
+	}
+	if config.TargetGroupRefreshInterval.Duration <= 0 {
+		return fmt.Errorf("targetGroupRefreshInterval: must be positive")
+	}
+	if config.DeregisterMaxBackoff.Duration <= 0 {
+		return fmt.Errorf("deregisterMaxBackoff: must be positive")
+	}
+
+	if config.APIRetries < 0 {
+		return fmt.Errorf("apiRetries: must not be negative")
+	}
+	if config.AlertRegisterFailures < 1 {
+		return fmt.Errorf("alertRegisterFailures: must be positive")
+	}
+	if config.DeregisterAlertAttempts < 1 {
+		return fmt.Errorf("deregisterAlertAttempts: must be positive")
+	}
+	if config.GCMaxDeletions < 0 {
+		return fmt.Errorf("gcMaxDeletions: must not be negative")
+	}
+
+	if config.Policy != nil {
+		if config.PolicyName != "" {
+			return fmt.Errorf("policy: can not be used together with policyName")
+		}
+		if err := config.Policy.Validate(); err != nil {
+			return fmt.Errorf("policy: %v", err)
+		}
+	}
+
+	if err := notify.Validate(config.Notifiers); err != nil {
+		return fmt.Errorf("notifiers: %v", err)
+	}
+
+	return nil
+}
+
+// Merge returns current with the reload:"true" fields of next, the other
+// fields are only applied on restart. It also returns the json names of
+// those fields which differ.
+func Merge(current, next *elb_inject.Config) (*elb_inject.Config, []string) {
+	merged := *current
+	var restart []string
+
+	mergedValue := reflect.ValueOf(&merged).Elem()
+	nextValue := reflect.ValueOf(next).Elem()
+	t := mergedValue.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Tag.Get("reload") == "true" {
+			mergedValue.Field(i).Set(nextValue.Field(i))
+			continue
+		}
+		if !reflect.DeepEqual(mergedValue.Field(i).Interface(), nextValue.Field(i).Interface()) {
+			restart = append(restart, jsonName(field))
+		}
+	}
+	return &merged, restart
+}
+
+// Clone returns a deep copy of config
+func Clone(config *elb_inject.Config) *elb_inject.Config {
+	data, err := json.Marshal(config)
+	if err != nil {
+		panic(err)
+	}
+	clone := &elb_inject.Config{}
+	if err := json.Unmarshal(data, clone); err != nil {
+		panic(err)
+	}
+	return clone
+}
+
+// Watch polls path every interval and calls onChange with the new content
+// until stopCh is closed. Checking the content, not the mtime, also catches
+// ConfigMap volumes, which swap a symlink.
+func Watch(path string, interval time.Duration, stopCh <-chan struct{}, onChange func(data []byte)) {
+	var last [sha256.Size]byte
+	if data, err := ioutil.ReadFile(path); err == nil {
+		last = sha256.Sum256(data)
+	}
+
+	wait.Until(func() {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			klog.Errorf("[Config] can not read %s: %v", path, err)
+			return
+		}
+
+		sum := sha256.Sum256(data)
+		if bytes.Equal(sum[:], last[:]) {
+			return
+		}
+		last = sum
+
+		klog.Infof("[Config] %s changed", path)
+		onChange(data)
+	}, interval, stopCh)
+}
+
+func jsonName(field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
@@ -0,0 +1,90 @@
+package configfile
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/zduymz/elb-inject/pkg/apis/elb-inject"
+)
+
+func defaults() *elb_inject.Config {
+	return &elb_inject.Config{
+		AWSRegion:                  "us-west-2",
+		AnnotationPrefix:           "devops.apixio.com",
+		APIRetries:                 3,
+		ExcludeNamespaces:          []string{"kube-system"},
+		LedgerGCInterval:           metav1.Duration{Duration: 5 * time.Minute},
+		GCTargetGroupTag:           "elb-inject/managed=true",
+		GCReportOnly:               true,
+		AlertRegisterFailures:      5,
+		TargetGroupRefreshInterval: metav1.Duration{Duration: time.Minute},
+		DeregisterMaxBackoff:       metav1.Duration{Duration: 5 * time.Minute},
+		DeregisterAlertAttempts:    5,
+		HealthReport:               "annotation",
+		WebhookValidationMode:      "reject",
+	}
+}
+
+func TestParse(t *testing.T) {
+	config := defaults()
+	err := Parse([]byte(`
+awsRegion: us-east-1
+requestTimeout: 10s
+excludeNamespaces: [kube-system, monitor]
+gcReportOnly: false
+policy:
+  rules:
+  - namespaces: [team-a]
+    targetGroups: [team-a-*]
+`), config)
+	assert.Nil(t, err)
+	assert.Equal(t, "us-east-1", config.AWSRegion)
+	assert.Equal(t, 3, config.APIRetries)
+	assert.Equal(t, 10*time.Second, config.RequestTimeout.Duration)
+	assert.Equal(t, []string{"kube-system", "monitor"}, config.ExcludeNamespaces)
+	assert.False(t, config.GCReportOnly)
+	assert.Equal(t, 1, len(config.Policy.Rules))
+	assert.Nil(t, Validate(config))
+
+	assert.NotNil(t, Parse([]byte("awsRegoin: us-east-1"), defaults()))
+}
+
+func TestValidate(t *testing.T) {
+	assert.Nil(t, Validate(defaults()))
+
+	for _, data := range []string{
+		"webhookValidationMode: ignore",
+		"annotationPrefix: ''",
+		"legacyAnnotationPrefixes: [Example.com/]",
+		"namespaceSelector: 'a b'",
+		"gcPodCIDRs: [10.0.0.0/33]",
+		"gcTargetGroupTag: ''",
+		"gcGracePeriod: -1m",
+		"ledgerGCInterval: 0s",
+		"policyName: elb-inject-policy\npolicy: {defaultAllow: true}",
+		"policy: {rules: [{namespaces: ['[']}]}",
+	} {
+		config := defaults()
+		assert.Nil(t, Parse([]byte(data), config))
+		assert.NotNil(t, Validate(config), data)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	current := defaults()
+	next := Clone(current)
+	next.AWSRegion = "us-east-1"
+	next.GCReportOnly = false
+	next.ExcludeNamespaces = append(next.ExcludeNamespaces, "monitor")
+
+	merged, restart := Merge(current, next)
+	assert.Equal(t, []string{"awsRegion"}, restart)
+	assert.Equal(t, "us-west-2", merged.AWSRegion)
+	assert.False(t, merged.GCReportOnly)
+	assert.Equal(t, []string{"kube-system", "monitor"}, merged.ExcludeNamespaces)
+	// current is untouched
+	assert.True(t, current.GCReportOnly)
+}
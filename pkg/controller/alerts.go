@@ -0,0 +1,221 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+
+	"github.com/zduymz/elb-inject/pkg/dryrun"
+	"github.com/zduymz/elb-inject/pkg/ledger"
+	"github.com/zduymz/elb-inject/pkg/metrics"
+	"github.com/zduymz/elb-inject/pkg/notify"
+)
+
+// alerter deduplicates notifications, one bad deployment sends one message
+// per target group instead of one per pod. It outlives config reloads.
+type alerter struct {
+	mu sync.Mutex
+	// dedup key -> last time it was sent
+	sent map[string]time.Time
+	// dedup key -> alerts dropped since
+	suppressed map[string]int
+	// pod uid/target group -> consecutive register failures
+	failures map[string]int
+}
+
+func newAlerter() *alerter {
+	return &alerter{
+		sent:       make(map[string]time.Time),
+		suppressed: make(map[string]int),
+		failures:   make(map[string]int),
+	}
+}
+
+// dedupKey groups the pods of a deployment together
+func dedupKey(event notify.Event) string {
+	return event.Type + "/" + event.Namespace + "/" + event.TargetGroup
+}
+
+// alert sends event unless a similar one was sent within the dedup window
+func (c *Controller) alert(event notify.Event) {
+	s := c.settings()
+	a := c.alerts
+	key := dedupKey(event)
+	now := time.Now()
+
+	a.mu.Lock()
+	if last, ok := a.sent[key]; ok && now.Sub(last) < s.AlertDedupWindow.Duration {
+		a.suppressed[key]++
+		a.mu.Unlock()
+		klog.V(4).Infof("[Alert] suppressed %s: %s", event.Type, event.Message)
+		metrics.AlertsSuppressed.WithLabelValues(event.Type).Inc()
+		return
+	}
+	if n := a.suppressed[key]; n > 0 {
+		event.Message += fmt.Sprintf(" (%d similar alerts suppressed since %s)", n, a.sent[key].Format(time.RFC3339))
+	}
+	a.sent[key] = now
+	delete(a.suppressed, key)
+
+	// forget what is quiet for a while
+	for k, last := range a.sent {
+		if now.Sub(last) > 2*s.AlertDedupWindow.Duration {
+			delete(a.sent, k)
+			delete(a.suppressed, k)
+		}
+	}
+	a.mu.Unlock()
+
+	c.sendAlert(s, event)
+}
+
+// sendAlert hands event to the notifiers. In dry-run it is only logged and
+// recorded, nothing is sent.
+func (c *Controller) sendAlert(s *settings, event notify.Event) {
+	if c.dryRun != nil {
+		target := event.IP
+		if event.Pod != "" {
+			target = event.Namespace + "/" + event.Pod
+		}
+		c.dryRun.Record(dryrun.ActionAlert, event.TargetGroup, target, event.Type+": "+event.Message)
+		return
+	}
+
+	klog.Warningf("[Alert] %s: %s", event.Type, event.Message)
+	metrics.AlertsSent.WithLabelValues(event.Type).Inc()
+	s.notifier.Notify(event)
+}
+
+// registerFailed alerts once po failed AlertRegisterFailures times in a row to
+// register to targetGroup, and again after the dedup window while it keeps failing
+func (c *Controller) registerFailed(po *corev1.Pod, targetGroup string, err error) {
+	key := string(po.UID) + "/" + targetGroup
+
+	c.alerts.mu.Lock()
+	c.alerts.failures[key]++
+	failures := c.alerts.failures[key]
+	c.alerts.mu.Unlock()
+
+	if failures < c.settings().AlertRegisterFailures {
+		return
+	}
+	c.alert(notify.Event{
+		Type:        notify.EventRegisterFailed,
+		Namespace:   po.Namespace,
+		Pod:         po.Name,
+		TargetGroup: targetGroup,
+		Reason:      errorClass(err),
+		Message:     fmt.Sprintf("Pod %s/%s failed %d times to register to %s. Reason: %v", po.Namespace, po.Name, failures, targetGroup, err),
+	})
+}
+
+func (c *Controller) registerSucceeded(po *corev1.Pod, targetGroup string) {
+	c.alerts.mu.Lock()
+	defer c.alerts.mu.Unlock()
+
+	delete(c.alerts.failures, string(po.UID)+"/"+targetGroup)
+}
+
+// forgetFailures drops the failure counts of a deleted pod
+func (c *Controller) forgetFailures(po *corev1.Pod) {
+	c.alerts.mu.Lock()
+	defer c.alerts.mu.Unlock()
+
+	prefix := string(po.UID) + "/"
+	for key := range c.alerts.failures {
+		if strings.HasPrefix(key, prefix) {
+			delete(c.alerts.failures, key)
+		}
+	}
+}
+
+// runAlertChecks looks for pods stuck unregistered and registered targets
+// which stay unhealthy, the health watcher checks the targets when it runs
+func (c *Controller) runAlertChecks() {
+	c.checkStuckPods()
+
+	if c.settings().HealthInterval.Duration > 0 {
+		return
+	}
+	var entries []ledger.Entry
+	for _, entry := range c.ledger.ByTargetGroup("") {
+		if time.Since(entry.Time) >= c.settings().AlertUnhealthyAfter.Duration {
+			entries = append(entries, entry)
+		}
+	}
+	c.checkUnhealthyTargets(entries, c.describeTargetHealth(entries))
+}
+
+// checkStuckPods alerts on running pods not registered to a target group
+// they may use for AlertStuckAfter
+func (c *Controller) checkStuckPods() {
+	s := c.settings()
+	pods, err := c.podLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("[Alert] can not list pods: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, po := range pods {
+		if !c.isPodRunning(po) || po.Status.StartTime == nil || now.Sub(po.Status.StartTime.Time) < s.AlertStuckAfter.Duration {
+			continue
+		}
+		if !c.isNamespaceAllowed(po.Namespace) {
+			continue
+		}
+
+		registered := c.registrationsOf(po)
+		for _, targetGroup := range c.keys.targetGroupsOf(po) {
+			if containsRegistration(registered, targetGroup) {
+				continue
+			}
+			// denials have their own event and metric
+			if ok, _ := c.checkPolicy(po, targetGroup); !ok {
+				continue
+			}
+			c.alert(notify.Event{
+				Type:        notify.EventPodStuck,
+				Namespace:   po.Namespace,
+				Pod:         po.Name,
+				TargetGroup: targetGroup,
+				Message:     fmt.Sprintf("Pod %s/%s is running since %s but not registered to %s", po.Namespace, po.Name, po.Status.StartTime.Format(time.RFC3339), targetGroup),
+			})
+		}
+	}
+}
+
+// checkUnhealthyTargets alerts on targets we registered which are still
+// unhealthy AlertUnhealthyAfter later
+func (c *Controller) checkUnhealthyTargets(entries []ledger.Entry, health map[string]map[string]*elbv2.TargetHealth) {
+	s := c.settings()
+	now := time.Now()
+
+	for _, entry := range entries {
+		if now.Sub(entry.Time) < s.AlertUnhealthyAfter.Duration {
+			continue
+		}
+
+		targetHealth, ok := health[entry.TargetGroup][entry.IP]
+		if !ok || aws.StringValue(targetHealth.State) != elbv2.TargetHealthStateEnumUnhealthy {
+			continue
+		}
+		c.alert(notify.Event{
+			Type:        notify.EventTargetUnhealthy,
+			Namespace:   entry.Namespace,
+			Pod:         entry.Pod,
+			TargetGroup: entry.TargetGroup,
+			IP:          entry.IP,
+			Reason:      aws.StringValue(targetHealth.Reason),
+			Message: fmt.Sprintf("Pod %s/%s [%s] is unhealthy in %s since its registration at %s. Reason: %s",
+				entry.Namespace, entry.Pod, entry.IP, entry.TargetGroup, entry.Time.Format(time.RFC3339), aws.StringValue(targetHealth.Description)),
+		})
+	}
+}
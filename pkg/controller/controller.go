@@ -2,38 +2,59 @@ package controller
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
 	"github.com/zduymz/elb-inject/pkg/apis/elb-inject"
+	"github.com/zduymz/elb-inject/pkg/configfile"
+	"github.com/zduymz/elb-inject/pkg/dryrun"
+	"github.com/zduymz/elb-inject/pkg/ledger"
+	"github.com/zduymz/elb-inject/pkg/metrics"
+	"github.com/zduymz/elb-inject/pkg/notify"
+	"github.com/zduymz/elb-inject/pkg/policy"
 	"github.com/zduymz/elb-inject/pkg/provider"
 	"github.com/zduymz/elb-inject/pkg/utils"
 	"k8s.io/client-go/kubernetes"
 
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/apimachinery/pkg/util/wait"
 	coreinformers "k8s.io/client-go/informers/core/v1"
+	policyinformers "k8s.io/client-go/informers/policy/v1beta1"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	corelisters "k8s.io/client-go/listers/core/v1"
+	policylisters "k8s.io/client-go/listers/policy/v1beta1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/workqueue"
 	"k8s.io/klog"
 )
 
 const (
-	// add to pod when injection is done
-	annotationStatus = "devops.apixio.com/elb-inject-status"
+	controllerAgentName = "elb-inject"
 
-	// inject a pod ip to this target group
-	annotationInject = "devops.apixio.com/elb-inject-target-group-name"
+	// Reason for the event when pod ip can not be registered to the target group
+	ReasonRegisterRejected = "RegisterRejected"
+
+	// Reason for the event when the policy doesn't allow the pod to use the target group
+	ReasonPolicyDenied = "PolicyDenied"
 )
 
 var (
-	// exclude namespaces don't want to inject
-	kubeSystemNamespaces = []string{
+	// DefaultExcludeNamespaces are the Kubernetes system namespaces and our monitoring one
+	DefaultExcludeNamespaces = []string{
 		metav1.NamespaceSystem,
 		metav1.NamespacePublic,
 		"monitor",
@@ -41,37 +62,122 @@ var (
 )
 
 type Controller struct {
-	podLister     corelisters.PodLister
-	kubeclientset kubernetes.Interface
-	hasSynced     cache.InformerSynced
-	workqueue     workqueue.RateLimitingInterface
-	provider      *provider.AWSProvider
-	slack         utils.Slack
+	podLister corelisters.PodLister
+	// indexed by hostNetworkNodeIndex
+	podIndexer      cache.Indexer
+	namespaceLister corelisters.NamespaceLister
+	pdbLister       policylisters.PodDisruptionBudgetLister
+	kubeclientset   kubernetes.Interface
+	hasSynced       []cache.InformerSynced
+	workqueue       workqueue.RateLimitingInterface
+	deregistrations *deregisterQueue
+	provider        *provider.AWSProvider
+	recorder        record.EventRecorder
+	ledger          *ledger.Ledger
+	// nil when there is no policy ConfigMap
+	policy      *policy.Store
+	podSelector labels.Selector
+	keys        keys
+	// nil unless dry-run
+	dryRun *dryrun.Recorder
+	// pod uid -> []registration, the status we would have written in dry-run
+	dryRunStatus sync.Map
+	alerts       *alerter
+	// pod uid/target group/ip -> target state at the last health check
+	healthStates map[string]targetState
+	// pod uid/target group/ip -> time.Time, since when its deregistration is delayed
+	guardDelays sync.Map
+	// targets of target groups with a minimum healthy guard
+	guardTargets guardedTargets
+	// pod uid/target group -> reason of the last policy denial
+	policyDenials sync.Map
+
+	// *settings, swapped by Reload
+	current atomic.Value
 }
 
-func NewController(podInformer coreinformers.PodInformer, kubeclientset kubernetes.Interface, config *elb_inject.Config) (*Controller, error) {
+func NewController(podInformer coreinformers.PodInformer, namespaceInformer coreinformers.NamespaceInformer, pdbInformer policyinformers.PodDisruptionBudgetInformer, kubeclientset kubernetes.Interface, config *elb_inject.Config) (*Controller, error) {
+	if err := configfile.Validate(config); err != nil {
+		return nil, err
+	}
+
+	s, err := newSettings(config, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var dryRun *dryrun.Recorder
+	if config.DryRun {
+		klog.Warning("Dry-run: no aws changes and no pod writes are made")
+		dryRun = dryrun.NewRecorder()
+	}
+
 	klog.Info("Setting up AWS")
 
 	p, err := provider.NewAWSProvider(provider.AWSConfig{
-		Region:       config.AWSRegion,
-		AssumeRole:   config.AWSAssumeRole,
-		AWSCredsFile: config.AWSCredsFile,
-		APIRetries:   3,
-		DryRun:       false,
+		Region:          config.AWSRegion,
+		AssumeRole:      config.AWSAssumeRole,
+		AWSCredsFile:    config.AWSCredsFile,
+		APIRetries:      config.APIRetries,
+		RequestTimeout:  config.RequestTimeout.Duration,
+		DryRun:          dryRun,
+		VPCId:           config.AWSVPCId,
+		AllowOutsideVPC: config.AWSAllowOutsideVPC,
+
+		ClusterName:              config.ClusterName,
+		ClaimTargetGroups:        config.ClaimTargetGroups,
+		AllowForeignTargetGroups: config.AllowForeignTargetGroups,
 	})
 	if err != nil {
 		klog.Errorf("Error: %s", err.Error())
 		return nil, err
 	}
 
+	podSelector, err := labels.Parse(config.PodSelector)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pod selector: %v", err)
+	}
+
+	klog.Info("Creating event broadcaster")
+	eventBroadcaster := record.NewBroadcaster()
+	eventBroadcaster.StartLogging(klog.Infof)
+	// events are only logged in dry-run
+	if dryRun == nil {
+		eventBroadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeclientset.CoreV1().Events("")})
+	}
+	recorder := eventBroadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerAgentName})
+
+	l := ledger.NewLedger(kubeclientset, config.LedgerNamespace, config.LedgerName)
+	l.SetReadOnly(dryRun != nil)
+
+	var policyStore *policy.Store
+	if config.PolicyName != "" {
+		policyStore = policy.NewStore(kubeclientset, config.PolicyNamespace, config.PolicyName)
+	}
+
+	if err := podInformer.Informer().AddIndexers(cache.Indexers{hostNetworkNodeIndex: indexHostNetworkNode}); err != nil {
+		return nil, err
+	}
+
 	controller := &Controller{
-		podLister:     podInformer.Lister(),
-		hasSynced:     podInformer.Informer().HasSynced,
-		workqueue:     workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "ELB Register"),
-		provider:      p,
-		kubeclientset: kubeclientset,
-		slack:         utils.Slack{WebHookUrl: config.SlackWebHook},
+		podLister:       podInformer.Lister(),
+		podIndexer:      podInformer.Informer().GetIndexer(),
+		namespaceLister: namespaceInformer.Lister(),
+		pdbLister:       pdbInformer.Lister(),
+		hasSynced:       []cache.InformerSynced{podInformer.Informer().HasSynced, namespaceInformer.Informer().HasSynced, pdbInformer.Informer().HasSynced},
+		workqueue:       workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "ELB Register"),
+		deregistrations: newDeregisterQueue(config.DeregisterMaxBackoff.Duration),
+		provider:        p,
+		kubeclientset:   kubeclientset,
+		recorder:        recorder,
+		ledger:          l,
+		policy:          policyStore,
+		podSelector:     podSelector,
+		keys:            newKeys(config.AnnotationPrefix, config.LegacyAnnotationPrefixes),
+		dryRun:          dryRun,
+		alerts:          newAlerter(),
 	}
+	controller.current.Store(s)
 
 	klog.Info("Setting up event handlers")
 
@@ -88,6 +194,19 @@ func NewController(podInformer coreinformers.PodInformer, kubeclientset kubernet
 		DeleteFunc: controller.handleDeleteObject,
 	})
 
+	// the namespace selector can be added by a reload
+	namespaceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: controller.handleNamespace,
+		UpdateFunc: func(old, new interface{}) {
+			newOne := new.(*corev1.Namespace)
+			oldOne := old.(*corev1.Namespace)
+			if reflect.DeepEqual(newOne.Labels, oldOne.Labels) {
+				return
+			}
+			controller.handleNamespace(new)
+		},
+	})
+
 	return controller, nil
 }
 
@@ -95,21 +214,74 @@ func NewController(podInformer coreinformers.PodInformer, kubeclientset kubernet
 func (c *Controller) Run(threadiness int, stopCh <-chan struct{}) error {
 	defer utilruntime.HandleCrash()
 	defer c.workqueue.ShutDown()
+	defer c.deregistrations.ShutDown()
 
 	klog.Info("Starting controller")
 
+	hasSynced := c.hasSynced
+	if c.policy != nil {
+		go c.policy.Run(stopCh)
+		hasSynced = append(hasSynced, c.policy.HasSynced)
+	}
+
 	// Wait for the caches to be synced before starting workers
 	klog.Info("Waiting for informer caches to sync")
-	if ok := cache.WaitForCacheSync(stopCh, c.hasSynced); !ok {
+	if ok := cache.WaitForCacheSync(stopCh, hasSynced...); !ok {
 		return fmt.Errorf("failed to wait for caches to sync")
 	}
 
+	klog.Info("Loading ledger")
+	if err := c.ledger.Load(); err != nil {
+		return fmt.Errorf("failed to load ledger: %v", err)
+	}
+
+	go c.provider.RunTargetGroupRefresh(c.settings().TargetGroupRefreshInterval.Duration, stopCh)
+
 	klog.Info("Starting workers")
 	for i := 0; i < threadiness; i++ {
 		go wait.Until(c.runWorker, time.Second, stopCh)
+		go wait.Until(c.runDeregisterWorker, time.Second, stopCh)
 	}
 
 	klog.Info("Started workers")
+
+	// structural settings, Reload doesn't change them
+	config := c.settings()
+
+	go wait.Until(c.runLedgerGC, config.LedgerGCInterval.Duration, stopCh)
+
+	if config.GCInterval.Duration > 0 {
+		if config.PodSelector != "" || len(config.IncludeNamespaces) == 1 {
+			// pods outside of the informer would look dead
+			klog.Warning("Informer only watches part of the pods, orphaned target gc is disabled")
+		} else {
+			if len(config.GCPodCIDRs) == 0 {
+				klog.Warning("No pod cidrs given, orphaned target gc is idle until some are configured")
+			}
+			go wait.Until(c.runTargetGC, config.GCInterval.Duration, stopCh)
+		}
+	}
+
+	if config.AlertInterval.Duration > 0 {
+		go wait.Until(c.runAlertChecks, config.AlertInterval.Duration, stopCh)
+	}
+
+	if config.HealthInterval.Duration > 0 {
+		go wait.Until(c.runHealthCheck, config.HealthInterval.Duration, stopCh)
+	}
+
+	if config.HTTPListenAddress != "" {
+		go c.runHTTPServer(stopCh)
+	}
+
+	if config.WebhookListenAddress != "" {
+		go c.runWebhookServer(stopCh)
+	}
+
+	if config.SlackListenAddress != "" {
+		go c.runSlackServer(stopCh)
+	}
+
 	<-stopCh
 	klog.Info("Shutting down workers")
 
@@ -144,7 +316,8 @@ func (c *Controller) processNextWorkItem() bool {
 		// Run the syncHandler, passing it the namespace/name string of the
 		klog.V(4).Infof("[Register] Start: %s", key)
 		if err := c.syncHandler(key); err != nil {
-			if reflect.TypeOf(err) != reflect.TypeOf(utils.PodNotRun{}) {
+			var notRunning *utils.PodNotRun
+			if !errors.As(err, &notRunning) {
 				klog.V(4).Infof("Warning '%s': %v, Requeue", key, err)
 			}
 			c.workqueue.AddRateLimited(key)
@@ -177,7 +350,7 @@ func (c *Controller) syncHandler(key string) error {
 	// Get the pod with this namespace/name
 	po, err := c.podLister.Pods(namespace).Get(name)
 	if err != nil {
-		if errors.IsNotFound(err) {
+		if apierrors.IsNotFound(err) {
 			klog.Warningf("pod '%s' no longer exists", key)
 			return nil
 		}
@@ -192,38 +365,386 @@ func (c *Controller) syncHandler(key string) error {
 		return &utils.PodNotRun{}
 	}
 
-	// double check
+	// double check, the inject annotation may be removed but we still have to deregister
 	if should := c.shouldInject(po); !should {
 		return nil
 	}
 
-	if po.Annotations[annotationStatus] != "" {
+	registered := c.registrationsOf(po)
+	// a terminating pod asks for nothing, draining overlaps its preStop sleep
+	var desired []string
+	if po.DeletionTimestamp == nil {
+		// a denied target group is treated as removed
+		desired = c.allowedTargetGroups(po, c.keys.targetGroupsOf(po))
+	}
+
+	var syncErr error
+	var result []registration
+	delayed := false
+	// target group -> ip the pod is registered with now
+	resolved := make(map[string]string)
+
+	for _, targetGroup := range desired {
+		podIP, err := c.registerTargetGroup(po, targetGroup, registered)
+		if err != nil {
+			syncErr = err
+		}
+		if podIP != "" {
+			resolved[targetGroup] = podIP
+			result = append(result, registration{TargetGroup: targetGroup, IP: podIP})
+		}
+	}
+
+	// deregister from groups the pod no longer asks for and stale ips
+	for _, r := range registered {
+		podIP, ok := resolved[r.TargetGroup]
+		if podIP == r.IP {
+			continue
+		}
+		// pod still wants this target group but we could not register it, keep what we have
+		if !ok && containsString(desired, r.TargetGroup) {
+			result = append(result, r)
+			continue
+		}
+
+		if ok {
+			// the old ip may belong to another pod by now, the queue checks
+			c.deregister(string(po.UID), po.Namespace, po.Name, r.TargetGroup, r.IP)
+			continue
+		}
+
+		// the pod still runs, keep enough healthy targets behind
+		delay, err := c.guardedDeregister(po, r)
+		if delay {
+			delayed = true
+			result = append(result, r)
+			continue
+		}
+		if err != nil {
+			// keep it in the status so it is retried
+			syncErr = err
+			result = append(result, r)
+		}
+	}
+
+	if gate, ok := c.keys.readinessGateOf(po); ok {
+		// a target group added later, or a registration lost with a new ip,
+		// takes the pod out of ready again
+		var missing []string
+		for _, targetGroup := range desired {
+			if _, ok := resolved[targetGroup]; !ok {
+				missing = append(missing, targetGroup)
+			}
+		}
+		condition := corev1.PodCondition{Type: gate, Status: corev1.ConditionTrue}
+		if len(missing) > 0 {
+			condition.Status = corev1.ConditionFalse
+			condition.Reason = "TargetGroupsNotRegistered"
+			condition.Message = "Not registered to " + strings.Join(missing, ", ")
+		}
+		if len(desired) > 0 {
+			klog.V(4).Infof("Setting %s condition on pod %s to %s", gate, po.Name, condition.Status)
+			if err := c.patchPodCondition(po, condition); err != nil {
+				syncErr = err
+			}
+		}
+	}
+
+	if status := formatStatus(result); status != formatStatus(registered) || c.statusRewritePending(po) {
+		klog.V(4).Infof("Updating `injected` annotation of pod %s: %s", po.Name, status)
+		if err := c.updatePodAnnotation(po, result); err != nil {
+			return err
+		}
+	}
+
+	if delayed {
+		c.workqueue.AddAfter(key, guardRetryInterval)
+	}
+
+	return syncErr
+}
+
+// registerTargetGroup makes sure po is registered to targetGroup and returns the
+// registered ip. Empty ip means po is not registered (yet) to targetGroup.
+func (c *Controller) registerTargetGroup(po *corev1.Pod, targetGroup string, registered []registration) (string, error) {
+	// a miss already refreshed the target groups
+	ipAddressType, err := c.provider.GetIPAddressType(targetGroup)
+	if err != nil {
+		if errors.Is(err, utils.ErrNotFound) {
+			klog.Errorf("TargetGroupName: %s is not found", targetGroup)
+			c.alert(notify.Event{
+				Type:        notify.EventUnknownTargetGroup,
+				Namespace:   po.Namespace,
+				Pod:         po.Name,
+				TargetGroup: targetGroup,
+				Message:     fmt.Sprintf("Pod %s/%s asks for target group %s which doesn't exist", po.Namespace, po.Name, targetGroup),
+			})
+			return "", nil
+		}
+		return "", err
+	}
+
+	// dual-stack pod has both, pick the one the target group accepts
+	podIP := podAddress(po, ipAddressType)
+	if podIP == "" {
+		klog.Errorf("[Register] Pod %s has no %s address for Target: [%s]", po.Name, ipAddressType, targetGroup)
+		c.recorder.Eventf(po, corev1.EventTypeWarning, ReasonRegisterRejected, "Pod has no %s address for target group %s", ipAddressType, targetGroup)
+		return "", nil
+	}
+
+	for _, r := range registered {
+		if r.TargetGroup != targetGroup {
+			continue
+		}
+		if r.IP == podIP {
+			// registered before the ledger existed
+			if !containsEntry(c.ledger.ByPod(string(po.UID)), targetGroup, podIP) {
+				c.recordRegistration(po, targetGroup, podIP)
+			}
+			return podIP, nil
+		}
+		// pod keeps its name but got a new ip (sandbox recreated, static pod restarted)
+		klog.Infof("[Register] Pod %s ip changed from %s to %s", po.Name, r.IP, podIP)
+	}
+
+	if po.Spec.HostNetwork {
+		klog.Infof("[Register] Pod %s is on hostNetwork, registering node ip %s", po.Name, podIP)
+		if c.settings().HostNetworkConflictCheck {
+			if other := c.findHostNetworkConflict(po, targetGroup, podIP); other != "" {
+				klog.Errorf("[Register] Pod %s conflicts with %s on [%s %s]", po.Name, other, targetGroup, podIP)
+				c.recorder.Eventf(po, corev1.EventTypeWarning, ReasonRegisterRejected, "Pod %s already registered node ip %s to target group %s", other, podIP, targetGroup)
+				return "", nil
+			}
+		}
+	}
+
+	klog.Infof("[Register] Attaching [%s %s] to Target: [%s]", po.Name, podIP, targetGroup)
+	err = c.provider.RegisterIPToTargetGroup(&targetGroup, &podIP)
+	if err != nil && actionFor(err) == actionRefresh {
+		// recreated since the last describe, the cached arn is gone
+		klog.Warningf("[Register] Attaching [%s %s] to Target: [%s] failed, refreshing target groups. Reason: %v", po.Name, podIP, targetGroup, err)
+		c.provider.RefreshTargetGroups()
+		err = c.provider.RegisterIPToTargetGroup(&targetGroup, &podIP)
+	}
+	if err != nil {
+		if actionFor(err) == actionGiveUp {
+			// retrying won't help, target group, pod network or iam needs fixing
+			klog.Errorf("[Register] Attaching [%s %s] to Target: [%s] rejected. Reason: %v", po.Name, podIP, targetGroup, err)
+			c.recorder.Eventf(po, corev1.EventTypeWarning, ReasonRegisterRejected, "Can not register %s to target group %s: %v", podIP, targetGroup, err)
+			c.alert(notify.Event{
+				Type:        notify.EventRegisterFailed,
+				Namespace:   po.Namespace,
+				Pod:         po.Name,
+				TargetGroup: targetGroup,
+				IP:          podIP,
+				Reason:      errorClass(err),
+				Message:     fmt.Sprintf("Pod %s/%s [%s] rejected by target group %s: %v", po.Namespace, po.Name, podIP, targetGroup, err),
+			})
+			return "", nil
+		}
+		c.registerFailed(po, targetGroup, err)
+		return "", err
+	}
+	c.registerSucceeded(po, targetGroup)
+
+	klog.Infof("[Register] Attaching [%s %s] to Target: [%s] successfully", po.Name, podIP, targetGroup)
+	c.recordRegistration(po, targetGroup, podIP)
+	return podIP, nil
+}
+
+// allowedTargetGroups drops target groups po is not allowed to use by the policy
+func (c *Controller) allowedTargetGroups(po *corev1.Pod, targetGroups []string) []string {
+	if c.policy == nil && c.settings().Policy == nil {
+		return targetGroups
+	}
+
+	// before the policy ConfigMap is loaded nothing new is allowed, but what
+	// is registered stays, a missing ConfigMap must not empty target groups
+	pending := c.policy != nil && !c.policy.Loaded()
+
+	var allowed []string
+	for _, targetGroup := range targetGroups {
+		if pending && containsRegistration(c.registrationsOf(po), targetGroup) {
+			allowed = append(allowed, targetGroup)
+			continue
+		}
+		key := string(po.UID) + "/" + targetGroup
+		if ok, reason := c.checkPolicy(po, targetGroup); !ok {
+			// the pod is synced again on every update, only tell about a new denial
+			if previous, found := c.policyDenials.Load(key); !found || previous.(string) != reason {
+				c.policyDenials.Store(key, reason)
+				klog.Warningf("[Policy] Pod %s/%s denied to use [%s]: %s", po.Namespace, po.Name, targetGroup, reason)
+				c.recorder.Eventf(po, corev1.EventTypeWarning, ReasonPolicyDenied, "Target group %s denied by policy: %s", targetGroup, reason)
+				metrics.PolicyDenied.WithLabelValues(po.Namespace, targetGroup).Inc()
+			}
+			continue
+		}
+		c.policyDenials.Delete(key)
+		allowed = append(allowed, targetGroup)
+	}
+	return allowed
+}
+
+func (c *Controller) checkPolicy(po *corev1.Pod, targetGroupName string) (bool, string) {
+	inline := c.settings().Policy
+	if c.policy == nil && inline == nil {
+		return true, ""
+	}
+
+	targetGroup := policy.TargetGroup{Name: targetGroupName}
+	if tg, err := c.provider.LookupTargetGroup(targetGroupName); err == nil {
+		targetGroup.ARN = aws.StringValue(tg.TargetGroupArn)
+	}
+	if tags, err := c.provider.GetTargetGroupTags(targetGroupName); err == nil {
+		targetGroup.Tags = tags
+	}
+	if c.policy == nil {
+		return inline.Allowed(po, targetGroup)
+	}
+	return c.policy.Allowed(po, targetGroup)
+}
+
+// hostNetworkNodeIndex indexes hostNetwork pods by their node
+const hostNetworkNodeIndex = "hostNetworkNode"
+
+func indexHostNetworkNode(obj interface{}) ([]string, error) {
+	po, ok := obj.(*corev1.Pod)
+	if !ok || !po.Spec.HostNetwork || po.Spec.NodeName == "" {
+		return nil, nil
+	}
+	return []string{po.Spec.NodeName}, nil
+}
+
+// findHostNetworkConflict returns another hostNetwork pod on the same node which
+// already registered ip to targetGroup. Both share the same target, deleting one
+// of them would take the other out of the target group.
+// The target is the node ip and the target group port, so the same target
+// group and ip is the same host port.
+func (c *Controller) findHostNetworkConflict(po *corev1.Pod, targetGroup, ip string) string {
+	objs, err := c.podIndexer.ByIndex(hostNetworkNodeIndex, po.Spec.NodeName)
+	if err != nil {
+		klog.Errorf("Can not list hostNetwork pods of node %s: %v", po.Spec.NodeName, err)
+		return ""
+	}
+
+	for _, obj := range objs {
+		other := obj.(*corev1.Pod)
+		if other.UID == po.UID {
+			continue
+		}
+		for _, r := range c.registrationsOf(other) {
+			if r.TargetGroup == targetGroup && r.IP == ip {
+				return other.Namespace + "/" + other.Name
+			}
+		}
+	}
+	return ""
+}
+
+// updatePodAnnotation only patches the status annotation, a full Update keeps
+// conflicting with kubelet status updates. A status under a legacy prefix is removed.
+func (c *Controller) updatePodAnnotation(po *corev1.Pod, registrations []registration) error {
+	if c.dryRun != nil {
+		c.dryRunStatus.Store(po.UID, registrations)
+		c.dryRun.Record(dryrun.ActionAnnotate, "", po.Namespace+"/"+po.Name, formatStatus(registrations))
 		return nil
 	}
 
-	targetGroup := po.Annotations[annotationInject]
-	klog.Infof("[Register] Attaching [%s %s] to Target: [%s]", po.Name, po.Status.PodIP, targetGroup)
-	if err := c.provider.RegisterIPToTargetGroup(&targetGroup, &po.Status.PodIP); err != nil {
-		return err
+	var value interface{}
+	// null removes the annotation
+	if status := formatStatus(registrations); status != "" {
+		value = status
+	}
+
+	annotations := map[string]interface{}{c.keys.status: value}
+	for _, l := range c.keys.legacy {
+		if _, ok := po.Annotations[l.status]; ok {
+			annotations[l.status] = nil
+		}
 	}
 
-	klog.V(4).Infof("Adding `injected` annotation to pod %s", po.Name)
-	if err := c.updatePodAnnotation(po); err != nil {
+	return c.patchPodAnnotations(po, annotations)
+}
+
+// patchPodAnnotations merges annotations into po, a nil value removes one
+func (c *Controller) patchPodAnnotations(po *corev1.Pod, annotations map[string]interface{}) error {
+	if c.dryRun != nil {
+		for key, value := range annotations {
+			c.dryRun.Record(dryrun.ActionAnnotate, "", po.Namespace+"/"+po.Name, fmt.Sprintf("%s=%v", key, value))
+		}
+		return nil
+	}
+
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
 		return err
 	}
 
-	klog.Infof("[Register] Attaching [%s %s] to Target: [%s] successfully", po.Name, po.Status.PodIP, targetGroup)
-	return nil
+	ctx := context.Background()
+	_, err = c.kubeclientset.CoreV1().Pods(po.GetNamespace()).Patch(ctx, po.GetName(), types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
 }
 
-func (c *Controller) updatePodAnnotation(po *corev1.Pod) error {
-	poCopy := po.DeepCopy()
-	poCopy.Annotations[annotationStatus] = po.Status.PodIP
+func (c *Controller) updatePodCondition(po *corev1.Pod, conditionType corev1.PodConditionType, status corev1.ConditionStatus) error {
+	return c.patchPodCondition(po, corev1.PodCondition{Type: conditionType, Status: status})
+}
+
+// patchPodCondition sets condition on po unless it is already there. The
+// transition time only moves when the status changes.
+func (c *Controller) patchPodCondition(po *corev1.Pod, condition corev1.PodCondition) error {
+	condition.LastTransitionTime = metav1.Now()
+	for _, existing := range po.Status.Conditions {
+		if existing.Type != condition.Type || existing.Status != condition.Status {
+			continue
+		}
+		if existing.Reason == condition.Reason && existing.Message == condition.Message {
+			return nil
+		}
+		condition.LastTransitionTime = existing.LastTransitionTime
+	}
+
+	if c.dryRun != nil {
+		c.dryRun.Record(dryrun.ActionCondition, "", po.Namespace+"/"+po.Name, fmt.Sprintf("%s=%s", condition.Type, condition.Status))
+		return nil
+	}
+
+	// conditions are merged by type
+	patch, err := json.Marshal(map[string]interface{}{
+		"status": map[string]interface{}{
+			"conditions": []corev1.PodCondition{condition},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
 	ctx := context.Background()
-	_, err := c.kubeclientset.CoreV1().Pods(poCopy.GetNamespace()).Update(ctx, poCopy, metav1.UpdateOptions{})
+	_, err = c.kubeclientset.CoreV1().Pods(po.GetNamespace()).Patch(ctx, po.GetName(), types.StrategicMergePatchType, patch, metav1.PatchOptions{}, "status")
 	return err
 }
 
+func hasConditionTrue(pod *corev1.Pod, conditionType corev1.PodConditionType) bool {
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == conditionType {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+func hasReadinessGate(pod *corev1.Pod, conditionType corev1.PodConditionType) bool {
+	for _, gate := range pod.Spec.ReadinessGates {
+		if gate.ConditionType == conditionType {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Controller) enqueuePod(obj interface{}) {
 	var key string
 	var err error
@@ -234,27 +755,33 @@ func (c *Controller) enqueuePod(obj interface{}) {
 	c.workqueue.Add(key)
 }
 
-// TODO: this step is quite redundant, what tombstone is?
-func (c *Controller) handleAddObject(obj interface{}) {
-	var object metav1.Object
-	var ok bool
-	if object, ok = obj.(metav1.Object); !ok {
-		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
-		if !ok {
-			klog.Errorf("error decoding object, invalid type")
-			return
-		}
-		object, ok = tombstone.Obj.(metav1.Object)
-		if !ok {
-			klog.Errorf("error decoding object tombstone, invalid type")
-			return
-		}
-		klog.Infof("Recovered deleted object '%s' from tombstone", object.GetName())
+// podOf returns the pod of an informer event, a delete event missed while
+// the watch was down comes as a tombstone with the last known state
+func podOf(obj interface{}) (*corev1.Pod, bool) {
+	if po, ok := obj.(*corev1.Pod); ok {
+		return po, true
+	}
+	tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+	if !ok {
+		klog.Errorf("error decoding object, invalid type")
+		return nil, false
+	}
+	po, ok := tombstone.Obj.(*corev1.Pod)
+	if !ok {
+		klog.Errorf("error decoding object tombstone, invalid type")
+		return nil, false
 	}
+	klog.Infof("Recovered deleted object '%s' from tombstone", po.GetName())
+	return po, true
+}
 
-	klog.V(4).Infof("Processing object: %s", object.GetName())
+func (c *Controller) handleAddObject(obj interface{}) {
+	po, ok := podOf(obj)
+	if !ok {
+		return
+	}
 
-	po := obj.(*corev1.Pod)
+	klog.V(4).Infof("Processing object: %s", po.GetName())
 
 	if should := c.shouldInject(po); should {
 		klog.V(4).Infof("Injecting object: %s", po.GetName())
@@ -265,78 +792,223 @@ func (c *Controller) handleAddObject(obj interface{}) {
 }
 
 func (c *Controller) handleDeleteObject(obj interface{}) {
-	var object metav1.Object
-	var ok bool
-	if object, ok = obj.(metav1.Object); !ok {
-		tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
-		if !ok {
-			klog.Errorf("error decoding object, invalid type")
-			return
-		}
-		object, ok = tombstone.Obj.(metav1.Object)
-		if !ok {
-			klog.Errorf("error decoding object tombstone, invalid type")
-			return
-		}
-		klog.Infof("Recovered deleted object '%s' from tombstone", object.GetName())
+	po, ok := podOf(obj)
+	if !ok {
+		return
 	}
 
-	klog.V(4).Infof("Processing object: %s", object.GetName())
+	klog.V(4).Infof("Processing object: %s", po.GetName())
+
+	// with -pods.selector a pod whose labels stop matching leaves the informer
+	// but still runs, its targets stay until the ledger gc finds it gone
+	if c.podSelector != nil && !c.podSelector.Empty() && po.DeletionTimestamp == nil && !c.podGone(po.Namespace, po.Name, string(po.UID)) {
+		klog.Infof("Pod %s/%s no longer matches the pod selector, keeping its targets", po.Namespace, po.Name)
+		return
+	}
 
-	po := obj.(*corev1.Pod)
 	// some pod deleted so quickly. so can not get IP and failed to deregister bc missing IP
-	podIP := po.Annotations[annotationStatus]
 	podName := po.Name
-	targetGroup := po.Annotations[annotationInject]
-	// pod should have been injected
-	if po.Annotations[annotationStatus] == "" {
-		return
+	// pod should have been injected, annotations may be stripped so ask the ledger too
+	registrations := c.registrationsOf(po)
+	c.dryRunStatus.Delete(po.UID)
+	c.forgetFailures(po)
+	forgetPod(&c.guardDelays, po)
+	forgetPod(&c.policyDenials, po)
+	for _, entry := range c.ledger.ByPod(string(po.UID)) {
+		if !containsTarget(registrations, entry.TargetGroup, entry.IP) {
+			registrations = append(registrations, registration{TargetGroup: entry.TargetGroup, IP: entry.IP})
+		}
 	}
+	for _, r := range registrations {
+		c.deregister(string(po.UID), po.Namespace, podName, r.TargetGroup, r.IP)
+	}
+}
 
-	// pod should contain annotationInject
-	if targetGroup == "" {
-		return
+// forgetPod drops what m keeps about a deleted pod, keys start with its uid
+func forgetPod(m *sync.Map, po *corev1.Pod) {
+	prefix := string(po.UID) + "/"
+	m.Range(func(key, _ interface{}) bool {
+		if strings.HasPrefix(key.(string), prefix) {
+			m.Delete(key)
+		}
+		return true
+	})
+}
+
+// deregisterTarget deregisters r of po and forgets it in the ledger
+func (c *Controller) deregisterTarget(po *corev1.Pod, r registration) error {
+	klog.Infof("[Deregister] [%s %s] from [%s]", po.Name, r.IP, r.TargetGroup)
+	targetGroup, ip := r.TargetGroup, r.IP
+	if err := c.provider.DeregisterIPFromTargetGroup(&targetGroup, &ip); err != nil {
+		klog.Errorf("[Deregister] [%s %s] from [%s] failed. Reason: %v", po.Name, r.IP, r.TargetGroup, err)
+		return err
 	}
+	klog.Infof("[Deregister] [%s %s] from [%s] successfully", po.Name, r.IP, r.TargetGroup)
+	c.forgetRegistration(string(po.UID), r.TargetGroup, r.IP)
+	return nil
+}
 
-	klog.Infof("[Deregister] [%s %s] from [%s]", podName, podIP, targetGroup)
-	if err := c.provider.DeregisterIPFromTargetGroup(&targetGroup, &podIP); err != nil {
-		klog.Errorf("[Deregister] [%s %s] from [%s] failed. Reason: %v", podName, podIP, targetGroup, err)
+// recordRegistration keeps track of what we registered in the ledger
+func (c *Controller) recordRegistration(po *corev1.Pod, targetGroup, podIP string) {
+	entry := ledger.Entry{
+		PodUID:      string(po.UID),
+		Namespace:   po.Namespace,
+		Pod:         po.Name,
+		IP:          podIP,
+		TargetGroup: targetGroup,
+		Time:        time.Now(),
+	}
+	if tg, err := c.provider.LookupTargetGroup(targetGroup); err == nil {
+		entry.TargetGroupARN = aws.StringValue(tg.TargetGroupArn)
+		entry.Port = aws.Int64Value(tg.Port)
+	}
 
-		if reflect.TypeOf(err) == reflect.TypeOf(utils.AWSDeregisterError{}) {
-			err1 := err.(utils.AWSDeregisterError)
-			slackMsg := fmt.Sprintf("```Can not deregister pod %s[%s] from %s. Reason: %v \n aws elbv2 deregister-targets --target-group-arn %s --targets Id=%s```", podName, podIP, targetGroup, err1.Error(), err1.TargetGroupARN, podIP)
+	if err := c.ledger.Record(entry); err != nil {
+		klog.Errorf("Ledger: can not record [%s %s] to [%s]: %v", po.Name, podIP, targetGroup, err)
+	}
+}
 
-			if err := c.slack.SendSlackNotification(slackMsg); err != nil {
-				klog.Errorf("Slack sending error %v", err)
-				klog.Error(slackMsg)
-			}
-		}
+func (c *Controller) forgetRegistration(podUID, targetGroup, podIP string) {
+	if err := c.ledger.Remove(podUID, targetGroup, podIP); err != nil {
+		klog.Errorf("Ledger: can not remove [%s %s] from [%s]: %v", podUID, podIP, targetGroup, err)
+	}
+}
 
+// runLedgerGC deregisters ledger entries of pods which no longer exist,
+// their delete event was missed or the annotations were gone
+func (c *Controller) runLedgerGC() {
+	pods, err := c.podLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("Ledger GC: can not list pods: %v", err)
 		return
 	}
-	klog.Infof("[Deregister] [%s %s] from [%s] successfully", podName, podIP, targetGroup)
+
+	live := make(map[string]bool)
+	for _, po := range pods {
+		live[string(po.UID)] = true
+	}
+
+	for _, uid := range c.ledger.PodUIDs() {
+		if live[uid] {
+			continue
+		}
+		entries := c.ledger.ByPod(uid)
+		if len(entries) == 0 || !c.podGone(entries[0].Namespace, entries[0].Pod, uid) {
+			continue
+		}
+		for _, entry := range entries {
+			klog.Infof("Ledger GC: pod %s/%s is gone", entry.Namespace, entry.Pod)
+			c.deregister(uid, entry.Namespace, entry.Pod, entry.TargetGroup, entry.IP)
+		}
+	}
+}
+
+// podGone asks the api server whether pod uid no longer exists. The informer
+// may only watch part of the pods (-pods.selector, -namespaces.include), a pod
+// outside of it is not gone.
+func (c *Controller) podGone(namespace, name, uid string) bool {
+	po, err := c.kubeclientset.CoreV1().Pods(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return true
+	}
+	if err != nil {
+		klog.Errorf("Ledger GC: can not get pod %s/%s: %v", namespace, name, err)
+		return false
+	}
+	// same name, new pod
+	return string(po.UID) != uid
 }
 
 func (c *Controller) shouldInject(pod *corev1.Pod) bool {
 
 	// Don't inject in the Kubernetes system namespaces
-	for _, ns := range kubeSystemNamespaces {
-		if pod.GetNamespace() == ns {
-			return false
+	if !c.isNamespaceAllowed(pod.GetNamespace()) {
+		return false
+	}
+
+	desired := c.keys.targetGroupsOf(pod)
+	registered := c.registrationsOf(pod)
+
+	// Only work with annotation defined, or what we registered before
+	if len(desired) == 0 && len(registered) == 0 {
+		return false
+	}
+
+	// terminating, deregister it before the containers stop
+	if pod.DeletionTimestamp != nil {
+		return len(registered) > 0
+	}
+
+	// rewrite status of older versions, it can not follow target group changes
+	if c.statusRewritePending(pod) {
+		return true
+	}
+
+	// target group added
+	for _, targetGroup := range desired {
+		if !containsRegistration(registered, targetGroup) {
+			return true
+		}
+	}
+
+	for _, r := range registered {
+		// target group removed
+		if !containsString(desired, r.TargetGroup) {
+			return true
+		}
+		// pod got a new ip
+		if pod.Status.PodIP != "" && !hasPodIP(pod, r.IP) {
+			return true
 		}
 	}
 
+	// readiness gate left False by a target group which is no longer asked for.
+	// Conditions are never written in dry-run.
+	if gate, ok := c.keys.readinessGateOf(pod); ok && len(desired) > 0 && c.dryRun == nil && !hasConditionTrue(pod, gate) {
+		return true
+	}
+
 	// If we already injected then don't do inject again
-	if pod.Annotations[annotationStatus] != "" {
+	return false
+}
+
+func (c *Controller) isNamespaceAllowed(namespace string) bool {
+	s := c.settings()
+	if containsString(s.ExcludeNamespaces, namespace) {
 		return false
 	}
 
-	// Only work with annotation defined
-	if pod.Annotations[annotationInject] == "" {
+	if len(s.IncludeNamespaces) > 0 && !containsString(s.IncludeNamespaces, namespace) {
 		return false
 	}
 
-	return true
+	if s.namespaceSelector == nil {
+		return true
+	}
+
+	ns, err := c.namespaceLister.Get(namespace)
+	if err != nil {
+		klog.V(4).Infof("Can not get namespace %s: %v", namespace, err)
+		return false
+	}
+	return s.namespaceSelector.Matches(labels.Set(ns.Labels))
+}
+
+// handleNamespace enqueues pods of a namespace which just got selected
+func (c *Controller) handleNamespace(obj interface{}) {
+	ns, ok := obj.(*corev1.Namespace)
+	if !ok || c.settings().namespaceSelector == nil || !c.isNamespaceAllowed(ns.Name) {
+		return
+	}
+
+	pods, err := c.podLister.Pods(ns.Name).List(labels.Everything())
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	for _, po := range pods {
+		c.handleAddObject(po)
+	}
 }
 
 func (c *Controller) isPodReady(pod *corev1.Pod) bool {
@@ -1,3 +1,1216 @@
 package controller
 
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/stretchr/testify/assert"
+	"github.com/zduymz/elb-inject/pkg/apis/elb-inject"
+	"github.com/zduymz/elb-inject/pkg/dryrun"
+	"github.com/zduymz/elb-inject/pkg/ledger"
+	"github.com/zduymz/elb-inject/pkg/notify"
+	"github.com/zduymz/elb-inject/pkg/policy"
+	"github.com/zduymz/elb-inject/pkg/provider"
+	"github.com/zduymz/elb-inject/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	policylisters "k8s.io/client-go/listers/policy/v1beta1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
 //TODO: how to write test cases
+
+var testKeys = newKeys(DefaultAnnotationPrefix, nil)
+
+func TestReadinessGatePatch(t *testing.T) {
+	po := &corev1.Pod{}
+	patches := readinessGatePatch(po, testKeys)
+	assert.Equal(t, 1, len(patches))
+	assert.Equal(t, "/spec/readinessGates", patches[0].Path)
+
+	po.Spec.ReadinessGates = []corev1.PodReadinessGate{{ConditionType: "foo"}}
+	patches = readinessGatePatch(po, testKeys)
+	assert.Equal(t, "/spec/readinessGates/-", patches[0].Path)
+
+	po.Spec.ReadinessGates = append(po.Spec.ReadinessGates, corev1.PodReadinessGate{ConditionType: testKeys.registered})
+	assert.Equal(t, 0, len(readinessGatePatch(po, testKeys)))
+}
+
+func TestPreStopPatch(t *testing.T) {
+	po := &corev1.Pod{
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app"},
+				{Name: "sidecar", Lifecycle: &corev1.Lifecycle{}},
+				{Name: "own-prestop", Lifecycle: &corev1.Lifecycle{PreStop: &corev1.Handler{}}},
+			},
+		},
+	}
+
+	// not opted in
+	containers, err := testKeys.preStopContainersOf(po)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(preStopPatch(po, 45, containers)))
+
+	po.Annotations = map[string]string{testKeys.preStopHook: "true"}
+	containers, err = testKeys.preStopContainersOf(po)
+	assert.Nil(t, err)
+	patches := preStopPatch(po, 45, containers)
+	assert.Equal(t, 3, len(patches))
+	assert.Equal(t, "/spec/containers/0/lifecycle", patches[0].Path)
+	assert.Equal(t, "/spec/containers/1/lifecycle/preStop", patches[1].Path)
+	assert.Equal(t, "/spec/terminationGracePeriodSeconds", patches[2].Path)
+	assert.Equal(t, int64(75), patches[2].Value)
+
+	// e.g. app is distroless, it has no sleep
+	po.Annotations[testKeys.preStopHook] = "sidecar"
+	containers, err = testKeys.preStopContainersOf(po)
+	assert.Nil(t, err)
+	patches = preStopPatch(po, 45, containers)
+	assert.Equal(t, 2, len(patches))
+	assert.Equal(t, "/spec/containers/1/lifecycle/preStop", patches[0].Path)
+
+	po.Annotations[testKeys.preStopHook] = "sidecar,missing"
+	_, err = testKeys.preStopContainersOf(po)
+	assert.NotNil(t, err)
+
+	gracePeriod := int64(600)
+	po.Spec.TerminationGracePeriodSeconds = &gracePeriod
+	assert.Equal(t, 2, len(preStopPatch(po, 45, []string{"app", "sidecar"})))
+
+	assert.Equal(t, 0, len(preStopPatch(po, 0, []string{"app", "sidecar"})))
+}
+
+func TestParseStatus(t *testing.T) {
+	po := &corev1.Pod{}
+	assert.Equal(t, 0, len(testKeys.parseStatus(po)))
+
+	// written by older versions
+	po.Annotations = map[string]string{testKeys.inject: "tg-a", testKeys.status: "10.0.0.1"}
+	assert.Equal(t, []registration{{TargetGroup: "tg-a", IP: "10.0.0.1"}}, testKeys.parseStatus(po))
+
+	registrations := []registration{{TargetGroup: "tg-a", IP: "10.0.0.1"}, {TargetGroup: "tg-b", IP: "2600::1"}}
+	po.Annotations[testKeys.status] = formatStatus(registrations)
+	assert.Equal(t, registrations, testKeys.parseStatus(po))
+}
+
+func TestPodAddress(t *testing.T) {
+	po := &corev1.Pod{
+		Status: corev1.PodStatus{
+			PodIP:  "10.0.0.1",
+			PodIPs: []corev1.PodIP{{IP: "10.0.0.1"}, {IP: "2600:1f14::1"}},
+		},
+	}
+	assert.Equal(t, "10.0.0.1", podAddress(po, "ipv4"))
+	assert.Equal(t, "2600:1f14::1", podAddress(po, "ipv6"))
+
+	po.Status.PodIPs = nil
+	assert.Equal(t, "", podAddress(po, "ipv6"))
+}
+
+func TestShouldInject(t *testing.T) {
+	c := &Controller{keys: testKeys}
+	c.current.Store(&settings{Config: &elb_inject.Config{ExcludeNamespaces: DefaultExcludeNamespaces}})
+	po := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Annotations: map[string]string{testKeys.inject: "tg-a"},
+		},
+		Status: corev1.PodStatus{PodIP: "10.0.0.1"},
+	}
+	assert.True(t, c.shouldInject(po))
+
+	po.Annotations[testKeys.status] = formatStatus([]registration{{TargetGroup: "tg-a", IP: "10.0.0.1"}})
+	assert.False(t, c.shouldInject(po))
+
+	// sandbox recreated with a new ip
+	po.Status.PodIP = "10.0.0.2"
+	assert.True(t, c.shouldInject(po))
+
+	po.Status.PodIP = ""
+	assert.False(t, c.shouldInject(po))
+
+	po.Status.PodIP = "10.0.0.1"
+	// target group changed
+	po.Annotations[testKeys.inject] = "tg-b"
+	assert.True(t, c.shouldInject(po))
+
+	// annotation removed, still has to deregister
+	delete(po.Annotations, testKeys.inject)
+	assert.True(t, c.shouldInject(po))
+
+	// written by older versions
+	po.Annotations[testKeys.inject] = "tg-a"
+	po.Annotations[testKeys.status] = "10.0.0.1"
+	assert.True(t, c.shouldInject(po))
+
+	po.Namespace = metav1.NamespaceSystem
+	po.Annotations[testKeys.status] = ""
+	assert.False(t, c.shouldInject(po))
+}
+
+func TestTargetGroupsOf(t *testing.T) {
+	po := &corev1.Pod{}
+	assert.Equal(t, 0, len(testKeys.targetGroupsOf(po)))
+
+	po.Annotations = map[string]string{testKeys.inject: "tg-a, tg-b,,tg-a"}
+	assert.Equal(t, []string{"tg-a", "tg-b"}, testKeys.targetGroupsOf(po))
+}
+
+func TestLegacyKeys(t *testing.T) {
+	k := newKeys("example.com", []string{DefaultAnnotationPrefix})
+	assert.Equal(t, "example.com/elb-inject-target-group-name", k.inject)
+
+	registrations := []registration{{TargetGroup: "tg-a", IP: "10.0.0.1"}}
+	po := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace:   "default",
+		Name:        "foo",
+		Annotations: map[string]string{testKeys.inject: "tg-a", testKeys.status: formatStatus(registrations)},
+	}}
+	po.Spec.ReadinessGates = []corev1.PodReadinessGate{{ConditionType: testKeys.registered}}
+	assert.Equal(t, []string{"tg-a"}, k.targetGroupsOf(po))
+	assert.Equal(t, registrations, k.parseStatus(po))
+	assert.True(t, k.hasLegacyStatus(po))
+	gate, ok := k.readinessGateOf(po)
+	assert.True(t, ok)
+	assert.Equal(t, testKeys.registered, gate)
+	assert.Equal(t, 0, len(readinessGatePatch(po, k)))
+
+	// the new key wins
+	po.Annotations[k.inject] = "tg-b"
+	assert.Equal(t, []string{"tg-b"}, k.targetGroupsOf(po))
+
+	// status moves to the new key
+	client := fake.NewSimpleClientset(po)
+	c := &Controller{kubeclientset: client, keys: k}
+	assert.Nil(t, c.updatePodAnnotation(po, registrations))
+	updated, _ := client.CoreV1().Pods("default").Get(context.Background(), "foo", metav1.GetOptions{})
+	_, found := updated.Annotations[testKeys.status]
+	assert.False(t, found)
+	assert.False(t, k.hasLegacyStatus(updated))
+	assert.Equal(t, registrations, k.parseStatus(updated))
+}
+
+func TestUpdatePodAnnotation(t *testing.T) {
+	po := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "foo"}}
+	client := fake.NewSimpleClientset(po)
+	c := &Controller{kubeclientset: client, keys: testKeys}
+
+	// pod without annotations
+	registrations := []registration{{TargetGroup: "tg-a", IP: "10.0.0.1"}}
+	assert.Nil(t, c.updatePodAnnotation(po, registrations))
+
+	updated, _ := client.CoreV1().Pods("default").Get(context.Background(), "foo", metav1.GetOptions{})
+	assert.Equal(t, registrations, testKeys.parseStatus(updated))
+
+	assert.Nil(t, c.updatePodAnnotation(updated, nil))
+	updated, _ = client.CoreV1().Pods("default").Get(context.Background(), "foo", metav1.GetOptions{})
+	_, found := updated.Annotations[testKeys.status]
+	assert.False(t, found)
+}
+
+func TestDryRunStatus(t *testing.T) {
+	po := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "foo", UID: "uid-1"}}
+	client := fake.NewSimpleClientset(po)
+	c := &Controller{kubeclientset: client, keys: testKeys, dryRun: dryrun.NewRecorder()}
+
+	registrations := []registration{{TargetGroup: "tg-a", IP: "10.0.0.1"}}
+	assert.Nil(t, c.updatePodAnnotation(po, registrations))
+	assert.Nil(t, c.updatePodCondition(po, testKeys.registered, corev1.ConditionTrue))
+
+	updated, _ := client.CoreV1().Pods("default").Get(context.Background(), "foo", metav1.GetOptions{})
+	assert.Equal(t, 0, len(updated.Annotations))
+	assert.Equal(t, 0, len(updated.Status.Conditions))
+	assert.Equal(t, registrations, c.registrationsOf(po))
+	assert.Equal(t, 1, c.dryRun.Summary().Counts[dryrun.ActionAnnotate])
+}
+
+func TestSettingsKeepNotifier(t *testing.T) {
+	first, err := newSettings(&elb_inject.Config{}, nil)
+	assert.Nil(t, err)
+	defer first.notifier.Close()
+
+	// the notifiers didn't change, queued events survive the reload
+	second, err := newSettings(&elb_inject.Config{AlertDedupWindow: metav1.Duration{Duration: time.Hour}}, first)
+	assert.Nil(t, err)
+	assert.True(t, first.notifier == second.notifier)
+
+	third, err := newSettings(&elb_inject.Config{SlackWebHook: "https://hooks.slack.com/services/x"}, second)
+	assert.Nil(t, err)
+	defer third.notifier.Close()
+	assert.False(t, second.notifier == third.notifier)
+}
+
+func TestAlertDedup(t *testing.T) {
+	notifier, _ := notify.NewDispatcher(nil, 0)
+	c := &Controller{alerts: newAlerter()}
+	c.current.Store(&settings{
+		Config: &elb_inject.Config{
+			AlertDedupWindow:      metav1.Duration{Duration: time.Hour},
+			AlertRegisterFailures: 2,
+		},
+		notifier: notifier,
+	})
+
+	event := notify.Event{Type: notify.EventPodStuck, Namespace: "team-a", TargetGroup: "tg-a"}
+	for _, pod := range []string{"web-0", "web-1", "web-2"} {
+		event.Pod = pod
+		c.alert(event)
+	}
+	key := dedupKey(event)
+	assert.Equal(t, 2, c.alerts.suppressed[key])
+
+	// window is over
+	c.alerts.sent[key] = time.Now().Add(-2 * time.Hour)
+	c.alert(event)
+	assert.Equal(t, 0, c.alerts.suppressed[key])
+
+	po := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "web-0", UID: "uid-1"}}
+	c.registerFailed(po, "tg-a", fmt.Errorf("throttled"))
+	assert.Equal(t, 1, c.alerts.failures["uid-1/tg-a"])
+	c.registerSucceeded(po, "tg-a")
+	assert.Equal(t, 0, len(c.alerts.failures))
+
+	// keeps failing, reported again once the window is over
+	failed := dedupKey(notify.Event{Type: notify.EventRegisterFailed, Namespace: "team-a", TargetGroup: "tg-a"})
+	c.registerFailed(po, "tg-a", fmt.Errorf("throttled"))
+	c.registerFailed(po, "tg-a", fmt.Errorf("throttled"))
+	_, sent := c.alerts.sent[failed]
+	assert.True(t, sent)
+	c.registerFailed(po, "tg-a", fmt.Errorf("throttled"))
+	assert.Equal(t, 1, c.alerts.suppressed[failed])
+	c.alerts.sent[failed] = time.Now().Add(-2 * time.Hour)
+	c.registerFailed(po, "tg-a", fmt.Errorf("throttled"))
+	assert.True(t, time.Since(c.alerts.sent[failed]) < time.Minute)
+	c.forgetFailures(po)
+	assert.Equal(t, 0, len(c.alerts.failures))
+}
+
+func TestUpdatePodCondition(t *testing.T) {
+	po := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "foo"}}
+	client := fake.NewSimpleClientset(po)
+	c := &Controller{kubeclientset: client, keys: testKeys}
+
+	assert.Nil(t, c.updatePodCondition(po, testKeys.registered, corev1.ConditionTrue))
+	updated, _ := client.CoreV1().Pods("default").Get(context.Background(), "foo", metav1.GetOptions{})
+	assert.Equal(t, 1, len(updated.Status.Conditions))
+	assert.Equal(t, testKeys.registered, updated.Status.Conditions[0].Type)
+}
+
+func TestTargetGC(t *testing.T) {
+	_, err := newTargetGC([]string{"10.0.0.0/33"}, "")
+	assert.NotNil(t, err)
+
+	gc, err := newTargetGC([]string{"100.64.0.0/16", "2600:1f14::/56"}, "elb-inject/managed=true")
+	assert.Nil(t, err)
+	assert.Equal(t, "elb-inject/managed", gc.tagKey)
+	assert.Equal(t, "true", gc.tagValue)
+
+	assert.True(t, gc.inPodCIDR("100.64.3.4"))
+	assert.True(t, gc.inPodCIDR("2600:1f14::1"))
+	assert.False(t, gc.inPodCIDR("10.0.0.1"))
+	assert.False(t, gc.inPodCIDR("i-0123456789"))
+}
+
+func TestIsNamespaceAllowed(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	_ = indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"elb-inject": "enabled"}}})
+	_ = indexer.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b"}})
+
+	c := &Controller{namespaceLister: corelisters.NewNamespaceLister(indexer)}
+	c.current.Store(&settings{Config: &elb_inject.Config{ExcludeNamespaces: DefaultExcludeNamespaces}})
+	assert.True(t, c.isNamespaceAllowed("team-a"))
+	assert.True(t, c.isNamespaceAllowed("team-b"))
+	assert.False(t, c.isNamespaceAllowed(metav1.NamespaceSystem))
+	assert.False(t, c.isNamespaceAllowed("monitor"))
+
+	c.settings().IncludeNamespaces = []string{"team-b"}
+	assert.False(t, c.isNamespaceAllowed("team-a"))
+	assert.True(t, c.isNamespaceAllowed("team-b"))
+
+	c.settings().IncludeNamespaces = nil
+	c.settings().namespaceSelector, _ = labels.Parse("elb-inject=enabled")
+	assert.True(t, c.isNamespaceAllowed("team-a"))
+	assert.False(t, c.isNamespaceAllowed("team-b"))
+	assert.False(t, c.isNamespaceAllowed("unknown"))
+}
+
+func TestDeregisterQueue(t *testing.T) {
+	q := newDeregisterQueue(time.Minute)
+	defer q.ShutDown()
+
+	key := deregisterKey{TargetGroup: "web", IP: "10.0.0.10"}
+	q.add(key, &pendingDeregistration{podUID: "uid-1", pod: "web-0", since: time.Now()})
+	// a second add, e.g. from the ledger gc, keeps the pod and the backoff
+	q.add(key, &pendingDeregistration{podUID: "uid-2", pod: "web-1", since: time.Now()})
+	assert.Equal(t, 1, q.Len())
+	assert.Equal(t, "uid-1", q.get(key).podUID)
+
+	failed, ok := q.failed(key)
+	assert.True(t, ok)
+	assert.Equal(t, 1, failed.attempts)
+
+	q.finish(key)
+	assert.Nil(t, q.get(key))
+	_, ok = q.failed(key)
+	assert.False(t, ok)
+}
+
+func TestDeregisterShouldEscalate(t *testing.T) {
+	now := time.Now()
+	d := pendingDeregistration{since: now.Add(-time.Minute), attempts: 2}
+
+	assert.False(t, d.shouldEscalate(5, 5*time.Minute, now))
+	assert.True(t, d.shouldEscalate(2, 5*time.Minute, now))
+	assert.True(t, d.shouldEscalate(5, time.Minute, now))
+	assert.False(t, d.shouldEscalate(5, 0, now))
+
+	d.escalated = true
+	assert.False(t, d.shouldEscalate(1, time.Minute, now))
+}
+
+func TestActionFor(t *testing.T) {
+	throttled := &utils.ProviderError{Class: utils.ErrThrottled, Op: "RegisterTargets", Err: awserr.New("Throttling", "Rate exceeded", nil)}
+	assert.Equal(t, actionRetry, actionFor(throttled))
+	assert.Equal(t, "Throttling", errorClass(throttled))
+
+	assert.Equal(t, actionRefresh, actionFor(utils.TargetGroupNotFound{Name: "web"}))
+	assert.Equal(t, actionGiveUp, actionFor(&utils.ProviderError{Class: utils.ErrAuthFailure, Err: fmt.Errorf("denied")}))
+	assert.Equal(t, actionGiveUp, actionFor(utils.TargetIPOutsideVPC{}))
+	assert.Equal(t, actionGiveUp, actionFor(utils.InvalidIPAddress{IP: "foo"}))
+	assert.Equal(t, actionGiveUp, actionFor(utils.TargetGroupNotIPType{Name: "web"}))
+	assert.Equal(t, actionGiveUp, actionFor(utils.TargetGroupVPCMismatch{Name: "web"}))
+	assert.Equal(t, actionGiveUp, actionFor(utils.TargetGroupClaimed{Name: "web"}))
+	assert.Equal(t, actionGiveUp, actionFor(fmt.Errorf("register: %w", utils.TargetGroupNotClaimed{Name: "web"})))
+	assert.Equal(t, actionRetry, actionFor(fmt.Errorf("boom")))
+
+	var notRunning *utils.PodNotRun
+	assert.True(t, errors.As(fmt.Errorf("sync: %w", &utils.PodNotRun{}), &notRunning))
+}
+
+func TestPodHealth(t *testing.T) {
+	entries := []ledger.Entry{
+		{PodUID: "uid-1", TargetGroup: "tg-b", IP: "10.0.0.1"},
+		{PodUID: "uid-1", TargetGroup: "tg-a", IP: "10.0.0.1"},
+		{PodUID: "uid-2", TargetGroup: "tg-a", IP: "10.0.0.2"},
+		{PodUID: "uid-3", TargetGroup: "tg-c", IP: "10.0.0.3"},
+	}
+	health := map[string]map[string]*elbv2.TargetHealth{
+		"tg-a": {
+			"10.0.0.1": {State: aws.String("healthy")},
+			"10.0.0.2": {State: aws.String("unhealthy"), Reason: aws.String("Target.FailedHealthChecks"), Description: aws.String("Health checks failed")},
+		},
+		"tg-b": {},
+	}
+
+	pods := podHealth(entries, health)
+	assert.Equal(t, []targetHealth{
+		{TargetGroup: "tg-a", IP: "10.0.0.1", State: "healthy"},
+		{TargetGroup: "tg-b", IP: "10.0.0.1", State: targetStateMissing},
+	}, pods["uid-1"])
+	assert.Equal(t, "Target.FailedHealthChecks", pods["uid-2"][0].Reason)
+	// tg-c couldn't be described
+	_, found := pods["uid-3"]
+	assert.False(t, found)
+
+	condition := healthCondition(testKeys.healthy, pods["uid-1"])
+	assert.Equal(t, corev1.ConditionFalse, condition.Status)
+	assert.Equal(t, "Missing", condition.Reason)
+
+	condition = healthCondition(testKeys.healthy, pods["uid-2"])
+	assert.Equal(t, "TargetFailedHealthChecks", condition.Reason)
+	assert.Equal(t, "tg-a [10.0.0.2] is unhealthy: Target.FailedHealthChecks Health checks failed", condition.Message)
+
+	condition = healthCondition(testKeys.healthy, pods["uid-1"][:1])
+	assert.Equal(t, corev1.ConditionTrue, condition.Status)
+}
+
+func TestPatchPodCondition(t *testing.T) {
+	po := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "foo"}}
+	client := fake.NewSimpleClientset(po)
+	c := &Controller{kubeclientset: client, keys: testKeys}
+
+	since := metav1.NewTime(time.Now().Add(-time.Hour).Truncate(time.Second))
+	po.Status.Conditions = []corev1.PodCondition{{Type: testKeys.healthy, Status: corev1.ConditionFalse, Reason: "Initial", LastTransitionTime: since}}
+
+	// same status, new reason: the transition time is kept
+	assert.Nil(t, c.patchPodCondition(po, corev1.PodCondition{Type: testKeys.healthy, Status: corev1.ConditionFalse, Reason: "TargetFailedHealthChecks"}))
+	updated, _ := client.CoreV1().Pods("default").Get(context.Background(), "foo", metav1.GetOptions{})
+	assert.Equal(t, "TargetFailedHealthChecks", updated.Status.Conditions[0].Reason)
+	assert.True(t, since.Equal(&updated.Status.Conditions[0].LastTransitionTime))
+}
+
+func TestRemediation(t *testing.T) {
+	po := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "foo", UID: "uid-1", Annotations: map[string]string{
+		testKeys.inject:      "tg-a",
+		testKeys.remediation: "quarantine",
+	}}}
+
+	action, after, err := testKeys.remediationOf(po, 10*time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, remediationQuarantine, action)
+	assert.Equal(t, 10*time.Minute, after)
+
+	po.Annotations[testKeys.remediationAfter] = "2m"
+	_, after, _ = testKeys.remediationOf(po, 10*time.Minute)
+	assert.Equal(t, 2*time.Minute, after)
+
+	po.Annotations[testKeys.remediationAfter] = "soon"
+	_, _, err = testKeys.remediationOf(po, 10*time.Minute)
+	assert.NotNil(t, err)
+	delete(po.Annotations, testKeys.remediationAfter)
+
+	now := time.Now()
+	targets := []targetHealth{{TargetGroup: "tg-a", IP: "10.0.0.1", State: "unhealthy"}, {TargetGroup: "tg-b", IP: "10.0.0.1", State: "unhealthy"}}
+	states := map[string]targetState{
+		targetStateKey(po, targets[0]): {state: "unhealthy", since: now.Add(-15 * time.Minute)},
+		targetStateKey(po, targets[1]): {state: "unhealthy", since: now.Add(-time.Minute)},
+	}
+	assert.Equal(t, targets[:1], overdueTargets(po, targets, states, 10*time.Minute, now))
+
+	client := fake.NewSimpleClientset(po)
+	c := &Controller{kubeclientset: client, keys: testKeys, recorder: record.NewFakeRecorder(10)}
+	c.current.Store(&settings{Config: &elb_inject.Config{RemediationUnhealthyAfter: metav1.Duration{Duration: 10 * time.Minute}}})
+	c.remediate(po, targets, states)
+
+	updated, _ := client.CoreV1().Pods("default").Get(context.Background(), "foo", metav1.GetOptions{})
+	assert.Equal(t, "true", updated.Labels[testKeys.quarantined])
+	// the next sync deregisters it
+	assert.Equal(t, 0, len(testKeys.targetGroupsOf(updated)))
+}
+
+func TestMinHealthyGuard(t *testing.T) {
+	po := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{testKeys.minHealthy: "2"}}}
+	n, err := testKeys.minHealthyOf(po)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, n)
+
+	po.Annotations[testKeys.minHealthy] = "-1"
+	_, err = testKeys.minHealthyOf(po)
+	assert.NotNil(t, err)
+
+	delete(po.Annotations, testKeys.minHealthy)
+	n, err = testKeys.minHealthyOf(po)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, n)
+
+	target := func(ip, state string) *elbv2.TargetHealthDescription {
+		return &elbv2.TargetHealthDescription{
+			Target:       &elbv2.TargetDescription{Id: aws.String(ip)},
+			TargetHealth: &elbv2.TargetHealth{State: aws.String(state)},
+		}
+	}
+	targets := []*elbv2.TargetHealthDescription{
+		target("10.0.0.1", "healthy"),
+		target("10.0.0.2", "healthy"),
+		target("10.0.0.3", "unhealthy"),
+	}
+	healthy, found := healthyTargets(targets, "10.0.0.1")
+	assert.Equal(t, 2, healthy)
+	assert.True(t, found)
+	// removing an unhealthy target doesn't change the healthy count
+	_, found = healthyTargets(targets, "10.0.0.3")
+	assert.False(t, found)
+}
+
+func TestLedgerGC(t *testing.T) {
+	// running, but outside of the informer, e.g. not matching -pods.selector
+	hidden := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "hidden", UID: "uid-1"}}
+	client := fake.NewSimpleClientset(hidden)
+	l := ledger.NewLedger(client, "default", "elb-inject-ledger")
+	assert.Nil(t, l.Load())
+	assert.Nil(t, l.Record(ledger.Entry{PodUID: "uid-1", Namespace: "default", Pod: "hidden", TargetGroup: "tg-a", IP: "10.0.0.1"}))
+	assert.Nil(t, l.Record(ledger.Entry{PodUID: "uid-2", Namespace: "default", Pod: "gone", TargetGroup: "tg-a", IP: "10.0.0.2"}))
+
+	c := &Controller{
+		kubeclientset:   client,
+		podLister:       corelisters.NewPodLister(cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})),
+		ledger:          l,
+		deregistrations: newDeregisterQueue(time.Minute),
+	}
+	c.runLedgerGC()
+
+	assert.Nil(t, c.deregistrations.get(deregisterKey{TargetGroup: "tg-a", IP: "10.0.0.1"}))
+	assert.NotNil(t, c.deregistrations.get(deregisterKey{TargetGroup: "tg-a", IP: "10.0.0.2"}))
+}
+
+// fakeELB is an in-memory load balancer, every target group is ip type
+type fakeELB struct {
+	mu sync.Mutex
+	// name -> ips and their health
+	targets map[string]map[string]string
+	tags    map[string]map[string]string
+	// returned by DeregisterTargets while not nil
+	deregisterErr  error
+	deregistered   []string
+	describeHealth int
+}
+
+func newFakeELB(targetGroups ...string) *fakeELB {
+	f := &fakeELB{targets: make(map[string]map[string]string), tags: make(map[string]map[string]string)}
+	for _, name := range targetGroups {
+		f.targets[name] = make(map[string]string)
+	}
+	return f
+}
+
+func fakeARN(name string) string {
+	return "arn:aws:elasticloadbalancing:us-west-2:123456789012:targetgroup/" + name + "/1"
+}
+
+func fakeName(arn *string) string {
+	return strings.Split(aws.StringValue(arn), "/")[1]
+}
+
+func (f *fakeELB) DescribeTargetGroups(_ *elbv2.DescribeTargetGroupsInput) (*elbv2.DescribeTargetGroupsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	output := &elbv2.DescribeTargetGroupsOutput{}
+	for name := range f.targets {
+		output.TargetGroups = append(output.TargetGroups, &elbv2.TargetGroup{
+			TargetGroupName: aws.String(name),
+			TargetGroupArn:  aws.String(fakeARN(name)),
+			TargetType:      aws.String(elbv2.TargetTypeEnumIp),
+			Port:            aws.Int64(80),
+		})
+	}
+	return output, nil
+}
+
+func (f *fakeELB) RegisterTargets(input *elbv2.RegisterTargetsInput) (*elbv2.RegisterTargetsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, target := range input.Targets {
+		f.targets[fakeName(input.TargetGroupArn)][aws.StringValue(target.Id)] = elbv2.TargetHealthStateEnumInitial
+	}
+	return &elbv2.RegisterTargetsOutput{}, nil
+}
+
+func (f *fakeELB) DeregisterTargets(input *elbv2.DeregisterTargetsInput) (*elbv2.DeregisterTargetsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.deregisterErr != nil {
+		return nil, f.deregisterErr
+	}
+	name := fakeName(input.TargetGroupArn)
+	for _, target := range input.Targets {
+		delete(f.targets[name], aws.StringValue(target.Id))
+		f.deregistered = append(f.deregistered, name+"/"+aws.StringValue(target.Id))
+	}
+	return &elbv2.DeregisterTargetsOutput{}, nil
+}
+
+func (f *fakeELB) DescribeTargetGroupAttributes(_ *elbv2.DescribeTargetGroupAttributesInput) (*elbv2.DescribeTargetGroupAttributesOutput, error) {
+	return &elbv2.DescribeTargetGroupAttributesOutput{}, nil
+}
+
+func (f *fakeELB) DescribeTargetHealth(input *elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.describeHealth++
+	output := &elbv2.DescribeTargetHealthOutput{}
+	for ip, state := range f.targets[fakeName(input.TargetGroupArn)] {
+		output.TargetHealthDescriptions = append(output.TargetHealthDescriptions, &elbv2.TargetHealthDescription{
+			Target:       &elbv2.TargetDescription{Id: aws.String(ip)},
+			TargetHealth: &elbv2.TargetHealth{State: aws.String(state)},
+		})
+	}
+	return output, nil
+}
+
+func (f *fakeELB) DescribeTags(input *elbv2.DescribeTagsInput) (*elbv2.DescribeTagsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	output := &elbv2.DescribeTagsOutput{}
+	for _, arn := range input.ResourceArns {
+		description := &elbv2.TagDescription{ResourceArn: arn}
+		for key, value := range f.tags[fakeName(arn)] {
+			description.Tags = append(description.Tags, &elbv2.Tag{Key: aws.String(key), Value: aws.String(value)})
+		}
+		output.TagDescriptions = append(output.TagDescriptions, description)
+	}
+	return output, nil
+}
+
+func (f *fakeELB) AddTags(_ *elbv2.AddTagsInput) (*elbv2.AddTagsOutput, error) {
+	return &elbv2.AddTagsOutput{}, nil
+}
+
+func (f *fakeELB) DescribeSubnets(_ *ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error) {
+	return &ec2.DescribeSubnetsOutput{Subnets: []*ec2.Subnet{{CidrBlock: aws.String("10.0.0.0/16")}}}, nil
+}
+
+func (f *fakeELB) setHealth(targetGroup, ip, state string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.targets[targetGroup][ip] = state
+}
+
+func newFakeProvider(f *fakeELB) *provider.AWSProvider {
+	return provider.NewAWSProviderWithClients(f, f, provider.AWSConfig{})
+}
+
+// events drains the events recorded so far
+func events(recorder *record.FakeRecorder) []string {
+	var recorded []string
+	for {
+		select {
+		case event := <-recorder.Events:
+			recorded = append(recorded, event)
+		default:
+			return recorded
+		}
+	}
+}
+
+func TestPolicyDeniedOnce(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	c := &Controller{provider: newFakeProvider(newFakeELB("team-b-web")), keys: testKeys, recorder: recorder}
+	c.current.Store(&settings{Config: &elb_inject.Config{Policy: &policy.Policy{
+		Rules: []policy.Rule{{Namespaces: []string{"team-a"}, TargetGroups: []string{"team-a-*"}}},
+	}}})
+
+	po := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "web-0", UID: "uid-1"}}
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, 0, len(c.allowedTargetGroups(po, []string{"team-b-web"})))
+	}
+	assert.Equal(t, 1, len(events(recorder)))
+
+	// a deleted pod starts over
+	forgetPod(&c.policyDenials, po)
+	c.allowedTargetGroups(po, []string{"team-b-web"})
+	assert.Equal(t, 1, len(events(recorder)))
+}
+
+// notifications returns a dispatcher posting every event to the returned channel
+func notifications(t *testing.T) (*notify.Dispatcher, <-chan notify.Event) {
+	events := make(chan notify.Event, 100)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event notify.Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err == nil {
+			events <- event
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	dispatcher, err := notify.NewDispatcher([]notify.Config{{Type: notify.TypeWebhook, URL: server.URL, RatePerMinute: 1000}}, 0)
+	assert.Nil(t, err)
+	t.Cleanup(dispatcher.Close)
+	return dispatcher, events
+}
+
+// received waits for n notifications
+func received(t *testing.T, events <-chan notify.Event, n int) []notify.Event {
+	var got []notify.Event
+	timeout := time.After(5 * time.Second)
+	for len(got) < n {
+		select {
+		case event := <-events:
+			got = append(got, event)
+		case <-timeout:
+			t.Fatalf("got %d notifications, expected %d", len(got), n)
+		}
+	}
+	return got
+}
+
+// newDeregisterController deregisters from elb, pods are the informer content
+func newDeregisterController(t *testing.T, elb *fakeELB, pods ...*corev1.Pod) (*Controller, <-chan notify.Event) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, po := range pods {
+		assert.Nil(t, indexer.Add(po))
+	}
+	client := fake.NewSimpleClientset()
+	l := ledger.NewLedger(client, "default", "elb-inject-ledger")
+	assert.Nil(t, l.Load())
+
+	dispatcher, events := notifications(t)
+	c := &Controller{
+		kubeclientset:   client,
+		podLister:       corelisters.NewPodLister(indexer),
+		provider:        newFakeProvider(elb),
+		ledger:          l,
+		keys:            testKeys,
+		recorder:        record.NewFakeRecorder(100),
+		deregistrations: newDeregisterQueue(time.Millisecond),
+		alerts:          newAlerter(),
+	}
+	c.current.Store(&settings{
+		Config: &elb_inject.Config{
+			LedgerGCInterval:        metav1.Duration{Duration: 5 * time.Minute},
+			AlertDedupWindow:        metav1.Duration{Duration: time.Hour},
+			DeregisterAlertAttempts: 2,
+		},
+		notifier: dispatcher,
+	})
+	return c, events
+}
+
+func TestDeregisterGiveUp(t *testing.T) {
+	elb := newFakeELB("tg-a")
+	elb.setHealth("tg-a", "10.0.0.1", "healthy")
+	elb.setHealth("tg-a", "10.0.0.2", "healthy")
+	elb.deregisterErr = awserr.New("AccessDenied", "not authorized", nil)
+	c, events := newDeregisterController(t, elb)
+
+	// a drain, every call fails the same way
+	c.deregister("uid-1", "default", "web-0", "tg-a", "10.0.0.1")
+	c.deregister("uid-2", "default", "web-1", "tg-a", "10.0.0.2")
+	c.processNextDeregistration()
+	c.processNextDeregistration()
+
+	// not deduped, both reach the aggregator
+	got := received(t, events, 2)
+	assert.Equal(t, notify.EventDeregisterFailed, got[0].Type)
+	assert.ElementsMatch(t, []string{"10.0.0.1", "10.0.0.2"}, []string{got[0].IP, got[1].IP})
+	assert.Equal(t, 0, c.deregistrations.Len())
+	assert.Nil(t, c.deregistrations.get(deregisterKey{TargetGroup: "tg-a", IP: "10.0.0.1"}))
+}
+
+// retryQueue records what AddAfter was asked to retry
+type retryQueue struct {
+	workqueue.RateLimitingInterface
+	mu      sync.Mutex
+	retried []interface{}
+}
+
+func (q *retryQueue) AddAfter(item interface{}, _ time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.retried = append(q.retried, item)
+}
+
+// rolloutPods are running pods which no longer ask for tg-a, one per ip
+func rolloutPods(ips ...string) []*corev1.Pod {
+	var pods []*corev1.Pod
+	for i, ip := range ips {
+		pods = append(pods, &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace:   "default",
+				Name:        fmt.Sprintf("web-%d", i),
+				UID:         types.UID(fmt.Sprintf("uid-%d", i)),
+				Annotations: map[string]string{testKeys.status: formatStatus([]registration{{TargetGroup: "tg-a", IP: ip}})},
+			},
+			Status: corev1.PodStatus{Phase: corev1.PodRunning, PodIP: ip},
+		})
+	}
+	return pods
+}
+
+// newGuardController guards tg-a of elb with a minimum of 2 healthy targets
+func newGuardController(t *testing.T, elb *fakeELB, pods []*corev1.Pod) (*Controller, *retryQueue) {
+	elb.tags["tg-a"] = map[string]string{provider.MinHealthyTargetsTagKey: "2"}
+	c, _ := newDeregisterController(t, elb, pods...)
+	var objects []runtime.Object
+	for _, po := range pods {
+		objects = append(objects, po)
+	}
+	c.kubeclientset = fake.NewSimpleClientset(objects...)
+	queue := &retryQueue{}
+	c.workqueue = queue
+	c.settings().MinHealthyMaxDelay = metav1.Duration{Duration: 10 * time.Minute}
+	return c, queue
+}
+
+func TestMinHealthyGuardSync(t *testing.T) {
+	elb := newFakeELB("tg-a")
+	elb.setHealth("tg-a", "10.0.0.1", "healthy")
+	elb.setHealth("tg-a", "10.0.0.2", "healthy")
+	elb.setHealth("tg-a", "10.0.0.3", "healthy")
+	// a rollout, both pods no longer ask for tg-a but still run
+	pods := rolloutPods("10.0.0.1", "10.0.0.2")
+	c, queue := newGuardController(t, elb, pods)
+	recorder := c.recorder.(*record.FakeRecorder)
+
+	// the first one leaves 2 healthy targets, the second one has to wait
+	assert.Nil(t, c.syncHandler("default/web-0"))
+	assert.Nil(t, c.syncHandler("default/web-1"))
+	assert.Equal(t, []string{"tg-a/10.0.0.1"}, elb.deregistered)
+	assert.Equal(t, []interface{}{"default/web-1"}, queue.retried)
+	delayed := events(recorder)
+	assert.Equal(t, 1, len(delayed))
+	assert.Contains(t, delayed[0], ReasonDeregistrationDelayed)
+
+	// its registration is kept
+	po, err := c.kubeclientset.CoreV1().Pods("default").Get(context.Background(), "web-1", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []registration{{TargetGroup: "tg-a", IP: "10.0.0.2"}}, testKeys.parseStatus(po))
+
+	// retries within guardRetryInterval share the described targets
+	assert.Nil(t, c.syncHandler("default/web-1"))
+	assert.Equal(t, 1, elb.describeHealth)
+	assert.Equal(t, 0, len(events(recorder)))
+
+	// waited long enough, deregistered anyway
+	c.guardDelays.Store("uid-1/tg-a/10.0.0.2", time.Now().Add(-time.Hour))
+	assert.Nil(t, c.syncHandler("default/web-1"))
+	assert.Equal(t, []string{"tg-a/10.0.0.1", "tg-a/10.0.0.2"}, elb.deregistered)
+	anyway := events(recorder)
+	assert.Equal(t, 1, len(anyway))
+	assert.Contains(t, anyway[0], "Warning "+ReasonDeregistrationDelayed)
+}
+
+func TestMinHealthyGuardConcurrent(t *testing.T) {
+	elb := newFakeELB("tg-a")
+	elb.setHealth("tg-a", "10.0.0.1", "healthy")
+	elb.setHealth("tg-a", "10.0.0.2", "healthy")
+	elb.setHealth("tg-a", "10.0.0.3", "healthy")
+	c, queue := newGuardController(t, elb, rolloutPods("10.0.0.1", "10.0.0.2"))
+
+	// two workers, only one of them may take the target group down to 2
+	var wg sync.WaitGroup
+	for _, key := range []string{"default/web-0", "default/web-1"} {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			assert.Nil(t, c.syncHandler(key))
+		}(key)
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, len(elb.deregistered))
+	assert.Equal(t, 1, len(queue.retried))
+}
+
+func TestDryRunAlert(t *testing.T) {
+	c, events := newDeregisterController(t, newFakeELB("tg-a"))
+	c.dryRun = dryrun.NewRecorder()
+
+	c.alert(notify.Event{Type: notify.EventTargetUnhealthy, Namespace: "default", Pod: "web-0", TargetGroup: "tg-a", Message: "unhealthy"})
+	c.sendAlert(c.settings(), notify.Event{Type: notify.EventDeregisterFailed, TargetGroup: "tg-a", IP: "10.0.0.1", Message: "giving up"})
+
+	summary := c.dryRun.Summary()
+	assert.Equal(t, 2, summary.Counts[dryrun.ActionAlert])
+	select {
+	case event := <-events:
+		t.Fatalf("notified in dry-run: %v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestHostNetworkConflict(t *testing.T) {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{hostNetworkNodeIndex: indexHostNetworkNode})
+	hostPod := func(name, node string, hostNetwork bool, registrations []registration) *corev1.Pod {
+		po := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID(name)},
+			Spec:       corev1.PodSpec{NodeName: node, HostNetwork: hostNetwork},
+		}
+		if registrations != nil {
+			po.Annotations = map[string]string{testKeys.status: formatStatus(registrations)}
+		}
+		assert.Nil(t, indexer.Add(po))
+		return po
+	}
+	registered := []registration{{TargetGroup: "tg-a", IP: "10.0.0.1"}}
+	hostPod("ingress-0", "node-a", true, registered)
+	// same target, but not sharing the node network
+	hostPod("web-0", "node-a", false, registered)
+	hostPod("ingress-1", "node-b", true, registered)
+	po := hostPod("ingress-2", "node-a", true, nil)
+
+	c := &Controller{podIndexer: indexer, keys: testKeys}
+	assert.Equal(t, "default/ingress-0", c.findHostNetworkConflict(po, "tg-a", "10.0.0.1"))
+	assert.Equal(t, "", c.findHostNetworkConflict(po, "tg-b", "10.0.0.1"))
+}
+
+func TestReadinessGateFalse(t *testing.T) {
+	elb := newFakeELB("tg-a")
+	elb.setHealth("tg-a", "10.0.0.1", "healthy")
+	po := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: "default",
+			Name:      "web-0",
+			UID:       "uid-0",
+			// tg-b doesn't exist
+			Annotations: map[string]string{
+				testKeys.inject: "tg-a,tg-b",
+				testKeys.status: formatStatus([]registration{{TargetGroup: "tg-a", IP: "10.0.0.1"}}),
+			},
+		},
+		Spec: corev1.PodSpec{ReadinessGates: []corev1.PodReadinessGate{{ConditionType: testKeys.registered}}},
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			PodIP:      "10.0.0.1",
+			Conditions: []corev1.PodCondition{{Type: testKeys.registered, Status: corev1.ConditionTrue}},
+		},
+	}
+	c, _ := newDeregisterController(t, elb, po)
+	c.kubeclientset = fake.NewSimpleClientset(po)
+
+	c.syncHandler("default/web-0")
+	updated, err := c.kubeclientset.CoreV1().Pods("default").Get(context.Background(), "web-0", metav1.GetOptions{})
+	assert.Nil(t, err)
+	condition := updated.Status.Conditions[0]
+	assert.Equal(t, corev1.ConditionFalse, condition.Status)
+	assert.Equal(t, "Not registered to tg-b", condition.Message)
+
+	// tg-b is no longer asked for, the informer caught up with the condition
+	po.Annotations[testKeys.inject] = "tg-a"
+	po.Status.Conditions = updated.Status.Conditions
+	c.syncHandler("default/web-0")
+	updated, err = c.kubeclientset.CoreV1().Pods("default").Get(context.Background(), "web-0", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, corev1.ConditionTrue, updated.Status.Conditions[0].Status)
+}
+
+func TestHealthStatesDescribeFailed(t *testing.T) {
+	// tg-b can't be described
+	elb := newFakeELB("tg-a")
+	elb.setHealth("tg-a", "10.0.0.1", "unhealthy")
+	po := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web-0", UID: "uid-0"},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning, PodIP: "10.0.0.1"},
+	}
+	c, _ := newDeregisterController(t, elb, po)
+	for _, targetGroup := range []string{"tg-a", "tg-b"} {
+		assert.Nil(t, c.ledger.Record(ledger.Entry{PodUID: "uid-0", Namespace: "default", Pod: "web-0", TargetGroup: targetGroup, IP: "10.0.0.1"}))
+	}
+
+	since := time.Now().Add(-time.Hour)
+	c.healthStates = map[string]targetState{
+		"uid-0/tg-a/10.0.0.1": {state: "unhealthy", since: since},
+		"uid-0/tg-b/10.0.0.1": {state: "unhealthy", since: since},
+	}
+	c.runHealthCheck()
+
+	assert.Equal(t, since, c.healthStates["uid-0/tg-a/10.0.0.1"].since)
+	assert.Equal(t, since, c.healthStates["uid-0/tg-b/10.0.0.1"].since)
+}
+
+func TestDeregisterInUse(t *testing.T) {
+	elb := newFakeELB("tg-a")
+	elb.setHealth("tg-a", "10.0.0.1", "healthy")
+	// got the ip of the deleted pod
+	reused := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "web-1",
+			UID:         "uid-1",
+			Annotations: map[string]string{testKeys.status: formatStatus([]registration{{TargetGroup: "tg-a", IP: "10.0.0.1"}})},
+		},
+		Status: corev1.PodStatus{Phase: corev1.PodRunning, PodIP: "10.0.0.1"},
+	}
+	c, _ := newDeregisterController(t, elb, reused)
+	assert.Nil(t, c.ledger.Record(ledger.Entry{PodUID: "uid-0", Namespace: "default", Pod: "web-0", TargetGroup: "tg-a", IP: "10.0.0.1"}))
+
+	c.deregister("uid-0", "default", "web-0", "tg-a", "10.0.0.1")
+	c.processNextDeregistration()
+
+	assert.Equal(t, 0, len(elb.deregistered))
+	assert.Nil(t, c.deregistrations.get(deregisterKey{TargetGroup: "tg-a", IP: "10.0.0.1"}))
+	assert.Equal(t, 0, len(c.ledger.ByPod("uid-0")))
+}
+
+func TestDeregisterRefreshAndEscalate(t *testing.T) {
+	elb := newFakeELB("tg-a")
+	elb.setHealth("tg-a", "10.0.0.1", "healthy")
+	elb.deregisterErr = awserr.New(elbv2.ErrCodeTargetGroupNotFoundException, "not found", nil)
+	c, events := newDeregisterController(t, elb)
+	key := deregisterKey{TargetGroup: "tg-a", IP: "10.0.0.1"}
+
+	// a not found refreshes the target groups and retries right away, once
+	c.deregister("uid-0", "default", "web-0", "tg-a", "10.0.0.1")
+	c.processNextDeregistration()
+	assert.True(t, c.deregistrations.get(key).refreshed)
+	assert.Equal(t, 1, c.deregistrations.Len())
+
+	// then it backs off like any other failure, escalated after 2 attempts
+	c.processNextDeregistration()
+	got := received(t, events, 1)
+	assert.Equal(t, notify.EventDeregisterFailed, got[0].Type)
+	assert.Contains(t, got[0].Message, "still retrying")
+	assert.True(t, c.deregistrations.get(key).escalated)
+
+	// escalated once, succeeds later
+	c.processNextDeregistration()
+	elb.mu.Lock()
+	elb.deregisterErr = nil
+	elb.mu.Unlock()
+	c.processNextDeregistration()
+	assert.Nil(t, c.deregistrations.get(key))
+	assert.Equal(t, []string{"tg-a/10.0.0.1"}, elb.deregistered)
+	select {
+	case event := <-events:
+		t.Fatalf("escalated twice: %v", event)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRunTargetGC(t *testing.T) {
+	elb := newFakeELB("tg-a", "tg-b")
+	elb.tags["tg-a"] = map[string]string{"elb-inject/gc": "true"}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.5", "192.168.0.1"} {
+		elb.setHealth("tg-a", ip, "healthy")
+	}
+	// not managed
+	elb.setHealth("tg-b", "10.0.0.4", "healthy")
+
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	livePod := func(name, ip string) {
+		assert.Nil(t, indexer.Add(&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, UID: types.UID(name)},
+			Status:     corev1.PodStatus{Phase: corev1.PodRunning, PodIP: ip},
+		}))
+	}
+	livePod("web-1", "10.0.0.1")
+
+	gc, err := newTargetGC([]string{"10.0.0.0/16"}, "elb-inject/gc=true")
+	assert.Nil(t, err)
+	c := &Controller{podLister: corelisters.NewPodLister(indexer), provider: newFakeProvider(elb)}
+	c.current.Store(&settings{Config: &elb_inject.Config{GCMaxDeletions: 1}, targetGC: gc})
+
+	// found orphaned, waits for the grace period
+	c.runTargetGC()
+	assert.Equal(t, 0, len(elb.deregistered))
+	assert.Equal(t, 3, len(gc.orphans))
+
+	// 10.0.0.3 came back, at most one deletion per cycle
+	livePod("web-3", "10.0.0.3")
+	c.runTargetGC()
+	assert.Equal(t, 1, len(elb.deregistered))
+	_, ok := gc.orphans["tg-a/10.0.0.3"]
+	assert.False(t, ok)
+
+	c.runTargetGC()
+	assert.ElementsMatch(t, []string{"tg-a/10.0.0.2", "tg-a/10.0.0.5"}, elb.deregistered)
+	assert.Equal(t, 0, len(gc.orphans))
+}
+
+func TestTerminatingPodDeregistered(t *testing.T) {
+	elb := newFakeELB("tg-a")
+	elb.setHealth("tg-a", "10.0.0.1", "healthy")
+	elb.setHealth("tg-a", "10.0.0.2", "healthy")
+	elb.setHealth("tg-a", "10.0.0.3", "healthy")
+	// still asks for tg-a, its preStop hook sleeps
+	pods := rolloutPods("10.0.0.1")
+	pods[0].Annotations[testKeys.inject] = "tg-a"
+	deleted := metav1.Now()
+	pods[0].DeletionTimestamp = &deleted
+	c, _ := newGuardController(t, elb, pods)
+
+	assert.True(t, c.shouldInject(pods[0]))
+	assert.Nil(t, c.syncHandler("default/web-0"))
+	assert.Equal(t, []string{"tg-a/10.0.0.1"}, elb.deregistered)
+
+	po, err := c.kubeclientset.CoreV1().Pods("default").Get(context.Background(), "web-0", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(testKeys.parseStatus(po)))
+	assert.False(t, c.shouldInject(po))
+}
+
+func TestStaleIPInUse(t *testing.T) {
+	elb := newFakeELB("tg-a")
+	elb.setHealth("tg-a", "10.0.0.1", "healthy")
+	// web-0 got a new sandbox, web-1 got its old ip and registered it
+	pods := rolloutPods("10.0.0.1", "10.0.0.1")
+	pods[0].Annotations[testKeys.inject] = "tg-a"
+	pods[0].Status.PodIP = "10.0.0.2"
+	pods[1].Annotations[testKeys.inject] = "tg-a"
+	c, _ := newGuardController(t, elb, pods)
+
+	assert.Nil(t, c.syncHandler("default/web-0"))
+	po, err := c.kubeclientset.CoreV1().Pods("default").Get(context.Background(), "web-0", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, []registration{{TargetGroup: "tg-a", IP: "10.0.0.2"}}, testKeys.parseStatus(po))
+
+	c.processNextDeregistration()
+	assert.Equal(t, 0, len(elb.deregistered))
+	assert.Equal(t, elbv2.TargetHealthStateEnumHealthy, elb.targets["tg-a"]["10.0.0.1"])
+}
+
+func TestDeleteTombstone(t *testing.T) {
+	elb := newFakeELB("tg-a")
+	c, _ := newDeregisterController(t, elb)
+	po := rolloutPods("10.0.0.1")[0]
+
+	// the delete event was missed while the watch was down
+	c.handleDeleteObject(cache.DeletedFinalStateUnknown{Key: "default/web-0", Obj: po})
+	assert.NotNil(t, c.deregistrations.get(deregisterKey{TargetGroup: "tg-a", IP: "10.0.0.1"}))
+
+	c.workqueue = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	c.handleAddObject(cache.DeletedFinalStateUnknown{Key: "default/web-0", Obj: po})
+	assert.Equal(t, 1, c.workqueue.Len())
+	c.handleDeleteObject(cache.DeletedFinalStateUnknown{Key: "default/web-0", Obj: "not a pod"})
+}
+
+func TestPodSelectorDropOut(t *testing.T) {
+	elb := newFakeELB("tg-a")
+	elb.setHealth("tg-a", "10.0.0.1", "healthy")
+	pods := rolloutPods("10.0.0.1")
+	pods[0].Annotations[testKeys.inject] = "tg-a"
+	c, _ := newGuardController(t, elb, pods)
+	c.podSelector = labels.SelectorFromSet(labels.Set{"app": "web"})
+	c.workqueue = workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	assert.Nil(t, c.ledger.Record(ledger.Entry{PodUID: "uid-0", Namespace: "default", Pod: "web-0", TargetGroup: "tg-a", IP: "10.0.0.1"}))
+	key := deregisterKey{TargetGroup: "tg-a", IP: "10.0.0.1"}
+
+	// relabeled, the informer deletes it but it still runs
+	c.handleDeleteObject(pods[0])
+	assert.Nil(t, c.deregistrations.get(key))
+	assert.Equal(t, 1, len(c.ledger.ByPod("uid-0")))
+
+	// back in the selector, still registered and nothing to do
+	pods[0].Labels = map[string]string{"app": "web"}
+	c.handleAddObject(pods[0])
+	assert.Equal(t, 0, c.workqueue.Len())
+	assert.Equal(t, elbv2.TargetHealthStateEnumHealthy, elb.targets["tg-a"]["10.0.0.1"])
+
+	// gone for real
+	assert.Nil(t, c.kubeclientset.CoreV1().Pods("default").Delete(context.Background(), "web-0", metav1.DeleteOptions{}))
+	c.handleDeleteObject(pods[0])
+	assert.NotNil(t, c.deregistrations.get(key))
+}
+
+func TestDisruptionBudgetGuard(t *testing.T) {
+	elb := newFakeELB("tg-a")
+	elb.setHealth("tg-a", "10.0.0.1", "healthy")
+	pods := rolloutPods("10.0.0.1")
+	pods[0].Labels = map[string]string{"app": "web"}
+	c, queue := newGuardController(t, elb, pods)
+	// no minimum, only the budget
+	delete(elb.tags, "tg-a")
+
+	budget := &policyv1beta1.PodDisruptionBudget{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "web"},
+		Spec:       policyv1beta1.PodDisruptionBudgetSpec{Selector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}},
+	}
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	assert.Nil(t, indexer.Add(budget))
+	c.pdbLister = policylisters.NewPodDisruptionBudgetLister(indexer)
+
+	assert.Nil(t, c.syncHandler("default/web-0"))
+	assert.Equal(t, 0, len(elb.deregistered))
+	assert.Equal(t, []interface{}{"default/web-0"}, queue.retried)
+	delayed := events(c.recorder.(*record.FakeRecorder))
+	assert.Equal(t, 1, len(delayed))
+	assert.Contains(t, delayed[0], "PodDisruptionBudget web")
+
+	budget.Status.DisruptionsAllowed = 1
+	assert.Nil(t, c.syncHandler("default/web-0"))
+	assert.Equal(t, []string{"tg-a/10.0.0.1"}, elb.deregistered)
+}
@@ -0,0 +1,267 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/klog"
+
+	"github.com/zduymz/elb-inject/pkg/metrics"
+	"github.com/zduymz/elb-inject/pkg/notify"
+	"github.com/zduymz/elb-inject/pkg/utils"
+)
+
+const (
+	// first wait after a failed deregistration, doubled on each failure
+	deregisterBaseBackoff = time.Second
+	// deregistrations per second over all target groups, stays below the elbv2 api limits
+	deregisterRate  = 10
+	deregisterBurst = 100
+)
+
+// deregisterKey is a target, a pod ip reused by a new pod is the same target
+type deregisterKey struct {
+	TargetGroup string
+	IP          string
+}
+
+// pendingDeregistration is the pod a target belonged to
+type pendingDeregistration struct {
+	podUID    string
+	namespace string
+	pod       string
+	// first attempt
+	since     time.Time
+	attempts  int
+	escalated bool
+	// the target groups were refreshed after a not found
+	refreshed bool
+}
+
+// shouldEscalate tells if a human should know about d by now
+func (d pendingDeregistration) shouldEscalate(attempts int, after time.Duration, now time.Time) bool {
+	if d.escalated {
+		return false
+	}
+	return d.attempts >= attempts || (after > 0 && now.Sub(d.since) >= after)
+}
+
+// deregisterQueue retries deregistrations of deleted pods, their objects are
+// gone so what to deregister is kept next to the queue
+type deregisterQueue struct {
+	workqueue.RateLimitingInterface
+
+	mu      sync.Mutex
+	pending map[deregisterKey]*pendingDeregistration
+}
+
+func newDeregisterQueue(maxBackoff time.Duration) *deregisterQueue {
+	rateLimiter := workqueue.NewMaxOfRateLimiter(
+		workqueue.NewItemExponentialFailureRateLimiter(deregisterBaseBackoff, maxBackoff),
+		&workqueue.BucketRateLimiter{Limiter: rate.NewLimiter(rate.Limit(deregisterRate), deregisterBurst)},
+	)
+	return &deregisterQueue{
+		RateLimitingInterface: workqueue.NewNamedRateLimitingQueue(rateLimiter, "ELB Deregister"),
+		pending:               make(map[deregisterKey]*pendingDeregistration),
+	}
+}
+
+// add queues key unless it is already pending, a second Add would skip its backoff
+func (q *deregisterQueue) add(key deregisterKey, d *pendingDeregistration) {
+	q.mu.Lock()
+	_, ok := q.pending[key]
+	if !ok {
+		q.pending[key] = d
+	}
+	q.mu.Unlock()
+
+	if !ok {
+		q.Add(key)
+	}
+}
+
+func (q *deregisterQueue) get(key deregisterKey) *pendingDeregistration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.pending[key]
+}
+
+// failed counts an attempt and returns a copy of the deregistration, false
+// when it was finished meanwhile, e.g. from slack
+func (q *deregisterQueue) failed(key deregisterKey) (pendingDeregistration, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	d, ok := q.pending[key]
+	if !ok {
+		return pendingDeregistration{}, false
+	}
+	d.attempts++
+	return *d, true
+}
+
+func (q *deregisterQueue) escalate(key deregisterKey) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if d, ok := q.pending[key]; ok {
+		d.escalated = true
+	}
+}
+
+func (q *deregisterQueue) refresh(key deregisterKey) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if d, ok := q.pending[key]; ok {
+		d.refreshed = true
+	}
+}
+
+// finish drops key, it is done or no longer ours to deregister
+func (q *deregisterQueue) finish(key deregisterKey) {
+	q.mu.Lock()
+	delete(q.pending, key)
+	q.mu.Unlock()
+
+	q.Forget(key)
+}
+
+// deregister queues the deregistration of podIP from targetGroup
+func (c *Controller) deregister(podUID, namespace, podName, targetGroup, podIP string) {
+	// pod should contain the inject annotation
+	if targetGroup == "" || podIP == "" {
+		return
+	}
+
+	c.deregistrations.add(deregisterKey{TargetGroup: targetGroup, IP: podIP}, &pendingDeregistration{
+		podUID:    podUID,
+		namespace: namespace,
+		pod:       podName,
+		since:     time.Now(),
+	})
+}
+
+func (c *Controller) runDeregisterWorker() {
+	for c.processNextDeregistration() {
+	}
+}
+
+func (c *Controller) processNextDeregistration() bool {
+	item, shutdown := c.deregistrations.Get()
+	if shutdown {
+		return false
+	}
+	defer c.deregistrations.Done(item)
+
+	key := item.(deregisterKey)
+	d := c.deregistrations.get(key)
+	if d == nil {
+		c.deregistrations.Forget(key)
+		return true
+	}
+
+	if pod := c.targetInUse(key.TargetGroup, key.IP, d.podUID); pod != "" {
+		klog.Infof("[Deregister] [%s %s] from [%s] skipped, the ip is now used by %s", d.pod, key.IP, key.TargetGroup, pod)
+		c.forgetRegistration(d.podUID, key.TargetGroup, key.IP)
+		c.deregistrations.finish(key)
+		return true
+	}
+
+	klog.Infof("[Deregister] [%s %s] from [%s]", d.pod, key.IP, key.TargetGroup)
+	targetGroup, podIP := key.TargetGroup, key.IP
+	err := c.provider.DeregisterIPFromTargetGroup(&targetGroup, &podIP)
+	if err == nil {
+		klog.Infof("[Deregister] [%s %s] from [%s] successfully", d.pod, key.IP, key.TargetGroup)
+		c.forgetRegistration(d.podUID, key.TargetGroup, key.IP)
+		c.deregistrations.finish(key)
+		return true
+	}
+
+	failed, ok := c.deregistrations.failed(key)
+	if !ok {
+		c.deregistrations.Forget(key)
+		return true
+	}
+	klog.Errorf("[Deregister] [%s %s] from [%s] failed, attempt %d. Reason: %v", d.pod, key.IP, key.TargetGroup, failed.attempts, err)
+	metrics.DeregisterFailures.WithLabelValues(key.TargetGroup).Inc()
+
+	switch actionFor(err) {
+	case actionRefresh:
+		if !failed.refreshed {
+			// the target group was recreated, the cached arn is gone
+			c.deregistrations.refresh(key)
+			c.provider.RefreshTargetGroups()
+			c.deregistrations.Add(key)
+			return true
+		}
+	case actionGiveUp:
+		// the ledger entry stays, the ledger gc queues it again. Not deduped
+		// like alerts, the aggregator batches the targets of a drain into one
+		// deregister-targets command.
+		s := c.settings()
+		c.deregistrations.finish(key)
+		event := deregisterEvent(key, failed, err, fmt.Sprintf("giving up until the next ledger gc in %s", s.LedgerGCInterval.Duration))
+		c.sendAlert(s, event)
+		return true
+	}
+
+	s := c.settings()
+	if failed.shouldEscalate(s.DeregisterAlertAttempts, s.DeregisterAlertAfter.Duration, time.Now()) {
+		c.deregistrations.escalate(key)
+		c.sendAlert(s, deregisterEvent(key, failed, err, "still retrying"))
+	}
+
+	c.deregistrations.AddRateLimited(key)
+	return true
+}
+
+// deregisterEvent tells a human about a failing deregistration, next is what
+// happens with it
+func deregisterEvent(key deregisterKey, d pendingDeregistration, err error, next string) notify.Event {
+	event := notify.Event{
+		Type:        notify.EventDeregisterFailed,
+		Namespace:   d.namespace,
+		Pod:         d.pod,
+		TargetGroup: key.TargetGroup,
+		IP:          key.IP,
+		Reason:      errorClass(err),
+		Message: fmt.Sprintf("Can not deregister pod %s[%s] from %s since %s (%d attempts), %s. Reason: %v",
+			d.pod, key.IP, key.TargetGroup, d.since.Format(time.RFC3339), d.attempts, next, err),
+	}
+	var perr *utils.ProviderError
+	if errors.As(err, &perr) && perr.TargetGroupARN != "" {
+		event.TargetGroupARN = perr.TargetGroupARN
+		event.Detail = fmt.Sprintf("aws elbv2 deregister-targets --target-group-arn %s --targets Id=%s", perr.TargetGroupARN, key.IP)
+	}
+	return event
+}
+
+// targetInUse returns the pod, other than podUID, registered or about to be
+// registered with ip to targetGroup, empty when there is none
+func (c *Controller) targetInUse(targetGroup, ip, podUID string) string {
+	pods, err := c.podLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("[Deregister] can not list pods: %v", err)
+		return ""
+	}
+
+	for _, po := range pods {
+		if string(po.UID) == podUID {
+			continue
+		}
+		if containsTarget(c.registrationsOf(po), targetGroup, ip) {
+			return po.Namespace + "/" + po.Name
+		}
+		if po.Status.PodIP == ip && po.DeletionTimestamp == nil && containsString(c.keys.targetGroupsOf(po), targetGroup) {
+			return po.Namespace + "/" + po.Name
+		}
+	}
+	return ""
+}
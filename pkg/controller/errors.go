@@ -0,0 +1,47 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+
+	"github.com/zduymz/elb-inject/pkg/utils"
+)
+
+// errorAction is what to do after a failed aws call
+type errorAction int
+
+const (
+	// retry with a backoff, the error goes away by itself
+	actionRetry errorAction = iota
+	// retrying won't help, a human has to fix something
+	actionGiveUp
+	// the cached target groups are stale, refresh them and retry once
+	actionRefresh
+)
+
+// actionFor picks the action for the class of err, unknown errors are retried
+func actionFor(err error) errorAction {
+	switch {
+	case errors.Is(err, utils.ErrNotFound):
+		return actionRefresh
+	case errors.Is(err, utils.ErrInvalidTarget), errors.Is(err, utils.ErrQuotaExceeded), errors.Is(err, utils.ErrAuthFailure):
+		return actionGiveUp
+	}
+	return actionRetry
+}
+
+// errorClass groups errors for notifications: the aws error code, the
+// provider error class or the go type otherwise
+func errorClass(err error) string {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		return aerr.Code()
+	}
+	var perr *utils.ProviderError
+	if errors.As(err, &perr) {
+		return perr.Class.Error()
+	}
+	return fmt.Sprintf("%T", err)
+}
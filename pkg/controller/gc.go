@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/zduymz/elb-inject/pkg/provider"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+)
+
+// targetGC removes ip targets which belong to no live pod, e.g. left behind
+// by a node failure. Only runs from its own goroutine.
+type targetGC struct {
+	podCIDRs []*net.IPNet
+	tagKey   string
+	tagValue string
+
+	// target group/ip -> first time we found it orphaned
+	orphans map[string]time.Time
+}
+
+func newTargetGC(podCIDRs []string, tag string) (*targetGC, error) {
+	gc := &targetGC{orphans: make(map[string]time.Time)}
+
+	for _, c := range podCIDRs {
+		_, cidr, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		gc.podCIDRs = append(gc.podCIDRs, cidr)
+	}
+
+	parts := strings.SplitN(tag, "=", 2)
+	gc.tagKey = parts[0]
+	if len(parts) == 2 {
+		gc.tagValue = parts[1]
+	}
+	return gc, nil
+}
+
+func (gc *targetGC) inPodCIDR(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, cidr := range gc.podCIDRs {
+		if cidr.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// runTargetGC deregisters orphaned targets of managed target groups once they
+// stay orphaned for GCGracePeriod, at most GCMaxDeletions per cycle
+func (c *Controller) runTargetGC() {
+	s := c.settings()
+	gc := s.targetGC
+	if len(gc.podCIDRs) == 0 {
+		return
+	}
+
+	pods, err := c.podLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("[GC] can not list pods: %v", err)
+		return
+	}
+
+	live := make(map[string]bool)
+	for _, po := range pods {
+		live[po.Status.PodIP] = true
+		for _, podIP := range po.Status.PodIPs {
+			live[podIP.IP] = true
+		}
+	}
+
+	// never touch target groups of another cluster
+	tagKey, tagValue := gc.tagKey, gc.tagValue
+	if s.ClusterName != "" {
+		tagKey, tagValue = provider.ClusterTagKey, s.ClusterName
+	}
+
+	targetGroups, err := c.provider.GetTargetGroupsByTag(tagKey, tagValue)
+	if err != nil {
+		klog.Errorf("[GC] can not list managed target groups: %v", err)
+		return
+	}
+
+	now := time.Now()
+	seen := make(map[string]bool)
+	deleted := 0
+
+	for _, targetGroup := range targetGroups {
+		targets, err := c.provider.DescribeTargets(targetGroup)
+		if err != nil {
+			klog.Errorf("[GC] can not describe targets of %s: %v", targetGroup, err)
+			continue
+		}
+
+		for _, target := range targets {
+			ip := aws.StringValue(target.Target.Id)
+			if !gc.inPodCIDR(ip) || live[ip] {
+				continue
+			}
+
+			key := targetGroup + "/" + ip
+			seen[key] = true
+			first, ok := gc.orphans[key]
+			if !ok {
+				klog.Infof("[GC] [%s] in [%s] belongs to no pod", ip, targetGroup)
+				gc.orphans[key] = now
+				continue
+			}
+			if now.Sub(first) < s.GCGracePeriod.Duration {
+				continue
+			}
+
+			if deleted >= s.GCMaxDeletions {
+				klog.Warningf("[GC] reached %d deletions, [%s] in [%s] waits for the next cycle", s.GCMaxDeletions, ip, targetGroup)
+				continue
+			}
+			deleted++
+
+			if s.GCReportOnly {
+				klog.Infof("[GC] report only: would deregister [%s] from [%s], orphaned since %s", ip, targetGroup, first.Format(time.RFC3339))
+				continue
+			}
+
+			klog.Infof("[GC] Deregister [%s] from [%s], orphaned since %s", ip, targetGroup, first.Format(time.RFC3339))
+			if err := c.provider.DeregisterTargets(targetGroup, []*elbv2.TargetDescription{target.Target}); err != nil {
+				klog.Errorf("[GC] Deregister [%s] from [%s] failed. Reason: %v", ip, targetGroup, err)
+				continue
+			}
+			delete(gc.orphans, key)
+		}
+	}
+
+	// came back or removed by someone else
+	for key := range gc.orphans {
+		if !seen[key] {
+			delete(gc.orphans, key)
+		}
+	}
+}
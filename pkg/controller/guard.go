@@ -0,0 +1,239 @@
+package controller
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/klog"
+
+	"github.com/zduymz/elb-inject/pkg/provider"
+)
+
+const (
+	// how often a pod with a delayed deregistration is synced again
+	guardRetryInterval = 15 * time.Second
+
+	// Reason for the event when a deregistration waits for the target group
+	// to have enough healthy targets, or for a disruption budget
+	ReasonDeregistrationDelayed = "DeregistrationDelayed"
+)
+
+// parseMinHealthy reads a minimum healthy targets annotation or tag
+func parseMinHealthy(value string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("expected a non-negative number, got %q", value)
+	}
+	return n, nil
+}
+
+// minHealthyOf reads the minimum healthy targets annotation of po, 0 when missing
+func (k keys) minHealthyOf(po *corev1.Pod) (int, error) {
+	value, ok := po.Annotations[k.minHealthy]
+	if !ok {
+		return 0, nil
+	}
+	n, err := parseMinHealthy(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", k.minHealthy, err)
+	}
+	return n, nil
+}
+
+// minHealthyTargets is the larger of the targetGroup tag and the po annotation
+func (c *Controller) minHealthyTargets(po *corev1.Pod, targetGroup string) int {
+	min, err := c.keys.minHealthyOf(po)
+	if err != nil {
+		klog.Warningf("[Deregister] pod %s/%s: %v", po.Namespace, po.Name, err)
+	}
+
+	tags, err := c.provider.GetTargetGroupTags(targetGroup)
+	if err != nil {
+		return min
+	}
+	if value, ok := tags[provider.MinHealthyTargetsTagKey]; ok {
+		n, err := parseMinHealthy(value)
+		if err != nil {
+			klog.Warningf("[Deregister] target group %s tag %s: %v", targetGroup, provider.MinHealthyTargetsTagKey, err)
+		} else if n > min {
+			min = n
+		}
+	}
+	return min
+}
+
+// disruptionBudgetsOf returns the PodDisruptionBudgets of a running po. A
+// terminating pod had its budget checked by the eviction, if any.
+func (c *Controller) disruptionBudgetsOf(po *corev1.Pod) []*policyv1beta1.PodDisruptionBudget {
+	if c.pdbLister == nil || po.DeletionTimestamp != nil || len(po.Labels) == 0 {
+		return nil
+	}
+	// also errors when there is none
+	budgets, err := c.pdbLister.GetPodPodDisruptionBudgets(po)
+	if err != nil {
+		klog.V(4).Infof("[Deregister] pod %s/%s: %v", po.Namespace, po.Name, err)
+		return nil
+	}
+	return budgets
+}
+
+// blockingBudget returns the first budget which allows no disruption
+func blockingBudget(budgets []*policyv1beta1.PodDisruptionBudget) *policyv1beta1.PodDisruptionBudget {
+	for _, budget := range budgets {
+		if budget.Status.DisruptionsAllowed < 1 {
+			return budget
+		}
+	}
+	return nil
+}
+
+// healthyTargets counts the healthy targets and tells whether ip is one of them
+func healthyTargets(targets []*elbv2.TargetHealthDescription, ip string) (int, bool) {
+	healthy, found := 0, false
+	for _, target := range targets {
+		if aws.StringValue(target.TargetHealth.State) != elbv2.TargetHealthStateEnumHealthy {
+			continue
+		}
+		healthy++
+		if aws.StringValue(target.Target.Id) == ip {
+			found = true
+		}
+	}
+	return healthy, found
+}
+
+// guardedTargets caches the targets of target groups with a minimum healthy
+// guard for guardRetryInterval, the delayed pods of a rollout share one
+// DescribeTargetHealth call per target group
+type guardedTargets struct {
+	mu     sync.Mutex
+	groups map[string]*guardedGroup
+}
+
+// guardedGroup is locked from the health check of a deregistration until
+// it is done, workers can't both remove the last targets above the minimum
+type guardedGroup struct {
+	sync.Mutex
+	targets   []*elbv2.TargetHealthDescription
+	described time.Time
+}
+
+// lock locks the guardedGroup of targetGroup and returns it
+func (g *guardedTargets) lock(targetGroup string) *guardedGroup {
+	g.mu.Lock()
+	if g.groups == nil {
+		g.groups = make(map[string]*guardedGroup)
+	}
+	group, ok := g.groups[targetGroup]
+	if !ok {
+		group = &guardedGroup{}
+		g.groups[targetGroup] = group
+	}
+	g.mu.Unlock()
+
+	group.Lock()
+	return group
+}
+
+// describe returns the targets of targetGroup, described again once the
+// cached ones are older than guardRetryInterval
+func (g *guardedGroup) describe(p *provider.AWSProvider, targetGroup string, now time.Time) ([]*elbv2.TargetHealthDescription, error) {
+	if g.targets != nil && now.Sub(g.described) < guardRetryInterval {
+		return g.targets, nil
+	}
+	targets, err := p.DescribeTargets(targetGroup)
+	if err != nil {
+		return nil, err
+	}
+	g.targets, g.described = targets, now
+	return targets, nil
+}
+
+// remove drops the target ip from the cached targets once it is deregistered
+func (g *guardedGroup) remove(ip string) {
+	targets := make([]*elbv2.TargetHealthDescription, 0, len(g.targets))
+	for _, target := range g.targets {
+		if aws.StringValue(target.Target.Id) != ip {
+			targets = append(targets, target)
+		}
+	}
+	g.targets = targets
+}
+
+func guardDelayKey(po *corev1.Pod, r registration) string {
+	return string(po.UID) + "/" + r.TargetGroup + "/" + r.IP
+}
+
+// guardedDeregister deregisters r, which po no longer asks for, unless
+// delayDeregistration holds it back. Deregistrations of a guarded target
+// group run one at a time.
+func (c *Controller) guardedDeregister(po *corev1.Pod, r registration) (bool, error) {
+	min := c.minHealthyTargets(po, r.TargetGroup)
+	budgets := c.disruptionBudgetsOf(po)
+	if min == 0 && len(budgets) == 0 {
+		c.guardDelays.Delete(guardDelayKey(po, r))
+		return false, c.deregisterTarget(po, r)
+	}
+
+	group := c.guardTargets.lock(r.TargetGroup)
+	defer group.Unlock()
+
+	if c.delayDeregistration(po, r, min, budgets, group) {
+		return true, nil
+	}
+	if err := c.deregisterTarget(po, r); err != nil {
+		return false, err
+	}
+	group.remove(r.IP)
+	return false, nil
+}
+
+// delayDeregistration tells whether the deregistration of r has to wait
+// because a PodDisruptionBudget of po allows no disruption, or because it
+// would leave the target group with fewer than min healthy targets. Removing
+// a target which isn't healthy never waits for min, no deregistration waits
+// longer than MinHealthyMaxDelay.
+func (c *Controller) delayDeregistration(po *corev1.Pod, r registration, min int, budgets []*policyv1beta1.PodDisruptionBudget, group *guardedGroup) bool {
+	key := guardDelayKey(po, r)
+	now := time.Now()
+
+	var why string
+	if budget := blockingBudget(budgets); budget != nil {
+		why = fmt.Sprintf("PodDisruptionBudget %s allows no disruption", budget.Name)
+	} else if min > 0 {
+		targets, err := group.describe(c.provider, r.TargetGroup, now)
+		if err != nil {
+			why = fmt.Sprintf("can not count its healthy targets: %v", err)
+		} else if healthy, ok := healthyTargets(targets, r.IP); ok && healthy-1 < min {
+			why = fmt.Sprintf("%d healthy targets would be left, at least %d are required", healthy-1, min)
+		}
+	}
+	if why == "" {
+		c.guardDelays.Delete(key)
+		return false
+	}
+
+	first, delayed := c.guardDelays.LoadOrStore(key, now)
+	since := first.(time.Time)
+
+	maxDelay := c.settings().MinHealthyMaxDelay.Duration
+	if maxDelay > 0 && now.Sub(since) >= maxDelay {
+		klog.Warningf("[Deregister] [%s %s] from [%s] delayed for %s, deregistering anyway: %s", po.Name, r.IP, r.TargetGroup, maxDelay, why)
+		c.recorder.Eventf(po, corev1.EventTypeWarning, ReasonDeregistrationDelayed, "Deregistering [%s] from %s after waiting %s: %s", r.IP, r.TargetGroup, maxDelay, why)
+		c.guardDelays.Delete(key)
+		return false
+	}
+
+	klog.Infof("[Deregister] [%s %s] from [%s] delayed: %s", po.Name, r.IP, r.TargetGroup, why)
+	if !delayed {
+		c.recorder.Eventf(po, corev1.EventTypeNormal, ReasonDeregistrationDelayed, "Deregistration of [%s] from %s is delayed: %s", r.IP, r.TargetGroup, why)
+	}
+	return true
+}
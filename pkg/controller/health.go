@@ -0,0 +1,240 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+
+	"github.com/zduymz/elb-inject/pkg/ledger"
+	"github.com/zduymz/elb-inject/pkg/metrics"
+)
+
+const (
+	// where runHealthCheck writes the health of a pod
+	healthReportAnnotation = "annotation"
+	healthReportCondition  = "condition"
+	healthReportBoth       = "both"
+
+	// a registered target the target group doesn't list
+	targetStateMissing = "missing"
+
+	// Reason for the event when a target of the pod becomes unhealthy
+	ReasonTargetUnhealthy = "TargetUnhealthy"
+)
+
+// targetHealth is a pod target as its load balancer sees it
+type targetHealth struct {
+	TargetGroup string `json:"targetGroup"`
+	IP          string `json:"ip"`
+	// initial, healthy, unhealthy, unused, draining, unavailable or missing
+	State string `json:"state"`
+	// e.g. Target.FailedHealthChecks, empty when healthy
+	Reason      string `json:"reason,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// targetState is the state of a target and since when it has it
+type targetState struct {
+	state string
+	since time.Time
+}
+
+// describeTargetHealth describes the target groups of entries, by target
+// group and ip. A target group which can't be described is left out.
+func (c *Controller) describeTargetHealth(entries []ledger.Entry) map[string]map[string]*elbv2.TargetHealth {
+	health := make(map[string]map[string]*elbv2.TargetHealth)
+	failed := make(map[string]bool)
+	for _, entry := range entries {
+		if _, ok := health[entry.TargetGroup]; ok || failed[entry.TargetGroup] {
+			continue
+		}
+
+		targets, err := c.provider.DescribeTargets(entry.TargetGroup)
+		if err != nil {
+			klog.Errorf("[Health] can not describe targets of %s: %v", entry.TargetGroup, err)
+			failed[entry.TargetGroup] = true
+			continue
+		}
+		health[entry.TargetGroup] = make(map[string]*elbv2.TargetHealth)
+		for _, target := range targets {
+			health[entry.TargetGroup][aws.StringValue(target.Target.Id)] = target.TargetHealth
+		}
+	}
+	return health
+}
+
+// podHealth groups the health of entries by pod uid
+func podHealth(entries []ledger.Entry, health map[string]map[string]*elbv2.TargetHealth) map[string][]targetHealth {
+	pods := make(map[string][]targetHealth)
+	for _, entry := range entries {
+		targets, ok := health[entry.TargetGroup]
+		if !ok {
+			continue
+		}
+
+		t := targetHealth{TargetGroup: entry.TargetGroup, IP: entry.IP, State: targetStateMissing}
+		if h, ok := targets[entry.IP]; ok {
+			t.State = aws.StringValue(h.State)
+			t.Reason = aws.StringValue(h.Reason)
+			t.Description = aws.StringValue(h.Description)
+		}
+		pods[entry.PodUID] = append(pods[entry.PodUID], t)
+	}
+
+	for _, targets := range pods {
+		sort.Slice(targets, func(i, j int) bool {
+			if targets[i].TargetGroup != targets[j].TargetGroup {
+				return targets[i].TargetGroup < targets[j].TargetGroup
+			}
+			return targets[i].IP < targets[j].IP
+		})
+	}
+	return pods
+}
+
+// healthCondition is True when every target is healthy, the reason of the
+// first one which isn't otherwise
+func healthCondition(conditionType corev1.PodConditionType, targets []targetHealth) corev1.PodCondition {
+	condition := corev1.PodCondition{Type: conditionType, Status: corev1.ConditionTrue, Reason: "Healthy"}
+
+	var messages []string
+	for _, t := range targets {
+		if t.State == elbv2.TargetHealthStateEnumHealthy {
+			continue
+		}
+		if condition.Status == corev1.ConditionTrue {
+			condition.Status = corev1.ConditionFalse
+			// Target.FailedHealthChecks -> TargetFailedHealthChecks
+			condition.Reason = strings.Replace(t.Reason, ".", "", -1)
+			if condition.Reason == "" {
+				condition.Reason = strings.Title(t.State)
+			}
+		}
+		msg := fmt.Sprintf("%s [%s] is %s", t.TargetGroup, t.IP, t.State)
+		if t.Reason != "" {
+			msg += fmt.Sprintf(": %s %s", t.Reason, t.Description)
+		}
+		messages = append(messages, msg)
+	}
+	condition.Message = strings.Join(messages, "; ")
+	return condition
+}
+
+// runHealthCheck polls the health of every target we registered, writes it
+// to its pod and exports it as metrics
+func (c *Controller) runHealthCheck() {
+	entries := c.ledger.ByTargetGroup("")
+	health := c.describeTargetHealth(entries)
+	pods := podHealth(entries, health)
+
+	metrics.Targets.Reset()
+	for _, targets := range pods {
+		for _, t := range targets {
+			metrics.Targets.WithLabelValues(t.TargetGroup, t.State, t.Reason).Inc()
+		}
+	}
+
+	if c.settings().AlertInterval.Duration > 0 {
+		c.checkUnhealthyTargets(entries, health)
+	}
+
+	// nothing was registered in dry-run, every target would look missing
+	if c.dryRun != nil {
+		return
+	}
+
+	seen := make(map[string]bool)
+	states := make(map[string]targetState)
+	for _, entry := range entries {
+		targets, ok := pods[entry.PodUID]
+		if !ok || seen[entry.PodUID] {
+			continue
+		}
+		seen[entry.PodUID] = true
+
+		po, err := c.podLister.Pods(entry.Namespace).Get(entry.Pod)
+		if err != nil || string(po.UID) != entry.PodUID {
+			continue
+		}
+		c.reportHealth(po, targets, states)
+		c.remediate(po, targets, states)
+	}
+	// a target group which couldn't be described keeps what we knew, its
+	// unhealthy targets don't start over
+	for _, entry := range entries {
+		if _, ok := health[entry.TargetGroup]; ok {
+			continue
+		}
+		key := entry.PodUID + "/" + entry.TargetGroup + "/" + entry.IP
+		if previous, ok := c.healthStates[key]; ok {
+			states[key] = previous
+		}
+		seen[entry.PodUID] = true
+	}
+	// pods which are gone are forgotten
+	c.healthStates = states
+	c.clearHealth(seen)
+}
+
+// reportHealth writes the health of po targets where HealthReport says and
+// records an event for every target which became unhealthy
+func (c *Controller) reportHealth(po *corev1.Pod, targets []targetHealth, states map[string]targetState) {
+	now := time.Now()
+	for _, t := range targets {
+		key := targetStateKey(po, t)
+		previous, ok := c.healthStates[key]
+		if ok && previous.state == t.State {
+			states[key] = previous
+			continue
+		}
+		states[key] = targetState{state: t.State, since: now}
+		if t.State == elbv2.TargetHealthStateEnumUnhealthy {
+			c.recorder.Eventf(po, corev1.EventTypeWarning, ReasonTargetUnhealthy, "Target [%s] is unhealthy in %s: %s %s", t.IP, t.TargetGroup, t.Reason, t.Description)
+		}
+	}
+
+	report := c.settings().HealthReport
+	if report == healthReportAnnotation || report == healthReportBoth {
+		value, _ := json.Marshal(targets)
+		if string(value) != po.Annotations[c.keys.health] {
+			if err := c.patchPodAnnotations(po, map[string]interface{}{c.keys.health: string(value)}); err != nil {
+				klog.Errorf("[Health] can not annotate pod %s/%s: %v", po.Namespace, po.Name, err)
+			}
+		}
+	}
+	if report == healthReportCondition || report == healthReportBoth {
+		if err := c.patchPodCondition(po, healthCondition(c.keys.healthy, targets)); err != nil {
+			klog.Errorf("[Health] can not set condition of pod %s/%s: %v", po.Namespace, po.Name, err)
+		}
+	}
+}
+
+func targetStateKey(po *corev1.Pod, t targetHealth) string {
+	return string(po.UID) + "/" + t.TargetGroup + "/" + t.IP
+}
+
+// clearHealth removes the health annotation of pods which have no registered
+// target anymore, e.g. their inject annotation was removed
+func (c *Controller) clearHealth(reported map[string]bool) {
+	pods, err := c.podLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("[Health] can not list pods: %v", err)
+		return
+	}
+	for _, po := range pods {
+		if _, ok := po.Annotations[c.keys.health]; !ok || reported[string(po.UID)] {
+			continue
+		}
+		if err := c.patchPodAnnotations(po, map[string]interface{}{c.keys.health: nil}); err != nil {
+			klog.Errorf("[Health] can not annotate pod %s/%s: %v", po.Namespace, po.Name, err)
+		}
+	}
+}
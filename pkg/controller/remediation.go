@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	corev1 "k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog"
+
+	"github.com/zduymz/elb-inject/pkg/metrics"
+)
+
+const (
+	// what the remediation annotation asks for
+	remediationQuarantine = "quarantine"
+	remediationEvict      = "evict"
+
+	// Reason for the event when a pod is taken out of its target groups
+	ReasonPodQuarantined = "PodQuarantined"
+
+	// Reason for the event when a pod is evicted
+	ReasonPodEvicted = "PodEvicted"
+
+	// Reason for the event when a remediation failed or a PodDisruptionBudget blocked it
+	ReasonRemediationFailed = "RemediationFailed"
+)
+
+// remediationOf returns the remediation po opted in to and how long a target
+// has to stay unhealthy before it, the action is empty when po didn't opt in
+func (k keys) remediationOf(po *corev1.Pod, defaultAfter time.Duration) (string, time.Duration, error) {
+	action := po.Annotations[k.remediation]
+	switch action {
+	case "":
+		return "", 0, nil
+	case remediationQuarantine, remediationEvict:
+	default:
+		return "", 0, fmt.Errorf("%s: unknown action %q, expected quarantine or evict", k.remediation, action)
+	}
+
+	after := defaultAfter
+	if value, ok := po.Annotations[k.remediationAfter]; ok {
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return "", 0, fmt.Errorf("%s: expected a positive duration, got %q", k.remediationAfter, value)
+		}
+		after = d
+	}
+	return action, after, nil
+}
+
+// overdueTargets returns targets of po unhealthy for at least after
+func overdueTargets(po *corev1.Pod, targets []targetHealth, states map[string]targetState, after time.Duration, now time.Time) []targetHealth {
+	var overdue []targetHealth
+	for _, t := range targets {
+		state, ok := states[targetStateKey(po, t)]
+		if ok && state.state == elbv2.TargetHealthStateEnumUnhealthy && now.Sub(state.since) >= after {
+			overdue = append(overdue, t)
+		}
+	}
+	return overdue
+}
+
+// remediate quarantines or evicts po, as its annotation asks, when one of its
+// targets stays unhealthy. Its kubelet probes may pass while the load
+// balancer health check fails, e.g. it listens on the wrong interface.
+func (c *Controller) remediate(po *corev1.Pod, targets []targetHealth, states map[string]targetState) {
+	defaultAfter := c.settings().RemediationUnhealthyAfter.Duration
+	if defaultAfter == 0 || po.DeletionTimestamp != nil {
+		return
+	}
+	if _, ok := po.Labels[c.keys.quarantined]; ok {
+		return
+	}
+
+	action, after, err := c.keys.remediationOf(po, defaultAfter)
+	if err != nil {
+		klog.V(2).Infof("[Remediation] pod %s/%s: %v", po.Namespace, po.Name, err)
+		return
+	}
+	if action == "" {
+		return
+	}
+
+	overdue := overdueTargets(po, targets, states, after, time.Now())
+	if len(overdue) == 0 {
+		return
+	}
+	var reasons []string
+	for _, t := range overdue {
+		reasons = append(reasons, fmt.Sprintf("[%s] in %s: %s", t.IP, t.TargetGroup, t.Reason))
+	}
+	why := fmt.Sprintf("unhealthy for %s %s", after, strings.Join(reasons, ", "))
+
+	switch action {
+	case remediationQuarantine:
+		err = c.quarantine(po, why)
+	case remediationEvict:
+		err = c.evict(po, why)
+	}
+	if err != nil {
+		klog.Errorf("[Remediation] can not %s pod %s/%s: %v", action, po.Namespace, po.Name, err)
+		c.recorder.Eventf(po, corev1.EventTypeWarning, ReasonRemediationFailed, "Can not %s pod %s: %v", action, why, err)
+		metrics.Remediations.WithLabelValues(action, "error").Inc()
+	}
+}
+
+// quarantine labels po, which makes the next sync deregister it from its
+// target groups. The pod keeps running for debugging until the label is removed.
+func (c *Controller) quarantine(po *corev1.Pod, why string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]string{c.keys.quarantined: "true"},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	if _, err := c.kubeclientset.CoreV1().Pods(po.Namespace).Patch(ctx, po.Name, types.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return err
+	}
+
+	klog.Infof("[Remediation] quarantined pod %s/%s, %s", po.Namespace, po.Name, why)
+	c.recorder.Eventf(po, corev1.EventTypeWarning, ReasonPodQuarantined, "Quarantined, %s. Its targets are deregistered, remove label %s to register it again", why, c.keys.quarantined)
+	metrics.Remediations.WithLabelValues(remediationQuarantine, "success").Inc()
+	return nil
+}
+
+// evict evicts po through the Eviction API, a PodDisruptionBudget which
+// doesn't allow it delays the eviction to the next health check
+func (c *Controller) evict(po *corev1.Pod, why string) error {
+	eviction := &policyv1beta1.Eviction{
+		ObjectMeta: metav1.ObjectMeta{Namespace: po.Namespace, Name: po.Name},
+	}
+
+	ctx := context.Background()
+	err := c.kubeclientset.CoreV1().Pods(po.Namespace).Evict(ctx, eviction)
+	if apierrors.IsTooManyRequests(err) {
+		klog.Infof("[Remediation] eviction of pod %s/%s is blocked by a disruption budget", po.Namespace, po.Name)
+		c.recorder.Eventf(po, corev1.EventTypeWarning, ReasonRemediationFailed, "Eviction is blocked by a PodDisruptionBudget, retrying. Pod is %s", why)
+		metrics.Remediations.WithLabelValues(remediationEvict, "blocked").Inc()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	klog.Infof("[Remediation] evicted pod %s/%s, %s", po.Namespace, po.Name, why)
+	c.recorder.Eventf(po, corev1.EventTypeWarning, ReasonPodEvicted, "Evicted, %s", why)
+	metrics.Remediations.WithLabelValues(remediationEvict, "success").Inc()
+	return nil
+}
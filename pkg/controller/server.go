@@ -0,0 +1,90 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog"
+)
+
+// runHTTPServer serves health and debug endpoints until stopCh is closed
+func (c *Controller) runHTTPServer(stopCh <-chan struct{}) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", c.serveHealth)
+	mux.HandleFunc("/ledger", c.serveLedger)
+	mux.HandleFunc("/dry-run", c.serveDryRun)
+	mux.Handle("/metrics", promhttp.Handler())
+
+	server := &http.Server{
+		Addr:    c.settings().HTTPListenAddress,
+		Handler: mux,
+	}
+
+	go func() {
+		<-stopCh
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+	}()
+
+	klog.Infof("Starting http server on %s", c.settings().HTTPListenAddress)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		klog.Errorf("Http server stopped: %v", err)
+	}
+}
+
+// serveLedger answers "what did elb-inject put in this group?",
+// /ledger?targetGroup=<name or arn>, everything without targetGroup
+func (c *Controller) serveLedger(w http.ResponseWriter, r *http.Request) {
+	entries := c.ledger.ByTargetGroup(r.URL.Query().Get("targetGroup"))
+
+	resp, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(resp)
+}
+
+// serveHealth also gives the counts of skipped mutations in dry-run
+func (c *Controller) serveHealth(w http.ResponseWriter, r *http.Request) {
+	if c.dryRun == nil {
+		_, _ = w.Write([]byte("ok"))
+		return
+	}
+
+	summary := c.dryRun.Summary()
+	var actions []string
+	for action := range summary.Counts {
+		actions = append(actions, action)
+	}
+	sort.Strings(actions)
+
+	msg := fmt.Sprintf("ok\ndry-run since %s:", summary.Since.Format(time.RFC3339))
+	for _, action := range actions {
+		msg += fmt.Sprintf(" %s=%d", action, summary.Counts[action])
+	}
+	_, _ = w.Write([]byte(msg + "\n"))
+}
+
+// serveDryRun lists the last mutations skipped in dry-run
+func (c *Controller) serveDryRun(w http.ResponseWriter, r *http.Request) {
+	if c.dryRun == nil {
+		http.Error(w, "not running in dry-run", http.StatusNotFound)
+		return
+	}
+
+	resp, err := json.MarshalIndent(c.dryRun.Summary(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(resp)
+}
@@ -0,0 +1,117 @@
+package controller
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+
+	"github.com/zduymz/elb-inject/pkg/apis/elb-inject"
+	"github.com/zduymz/elb-inject/pkg/configfile"
+	"github.com/zduymz/elb-inject/pkg/notify"
+)
+
+// settings is the config with everything derived from it. It is never
+// modified once in use, Reload swaps in a new one.
+type settings struct {
+	*elb_inject.Config
+
+	// only namespaces with these labels, nil means all
+	namespaceSelector labels.Selector
+	targetGC          *targetGC
+	notifier          *notify.Dispatcher
+}
+
+// newSettings derives the settings of config, the notifier of previous is
+// kept while the notifiers didn't change. previous is nil on start.
+func newSettings(config *elb_inject.Config, previous *settings) (*settings, error) {
+	gc, err := newTargetGC(config.GCPodCIDRs, config.GCTargetGroupTag)
+	if err != nil {
+		return nil, fmt.Errorf("invalid gc settings: %v", err)
+	}
+
+	var namespaceSelector labels.Selector
+	if config.NamespaceSelector != "" {
+		if namespaceSelector, err = labels.Parse(config.NamespaceSelector); err != nil {
+			return nil, fmt.Errorf("invalid namespace selector: %v", err)
+		}
+	}
+
+	var notifier *notify.Dispatcher
+	if previous != nil && sameNotifiers(previous.Config, config) {
+		notifier = previous.notifier
+	} else {
+		notifiers := config.Notifiers
+		if config.SlackWebHook != "" {
+			notifiers = append([]notify.Config{{Name: "slack", Type: notify.TypeSlack, URL: config.SlackWebHook}}, notifiers...)
+		}
+		if notifier, err = notify.NewDispatcher(notifiers, config.NotifyAggregateWindow.Duration); err != nil {
+			return nil, fmt.Errorf("invalid notifiers: %v", err)
+		}
+	}
+
+	return &settings{
+		Config:            config,
+		namespaceSelector: namespaceSelector,
+		targetGC:          gc,
+		notifier:          notifier,
+	}, nil
+}
+
+// sameNotifiers tells whether a and b configure the same notifiers
+func sameNotifiers(a, b *elb_inject.Config) bool {
+	return a.SlackWebHook == b.SlackWebHook &&
+		a.NotifyAggregateWindow == b.NotifyAggregateWindow &&
+		reflect.DeepEqual(a.Notifiers, b.Notifiers)
+}
+
+// settings returns the settings in use
+func (c *Controller) settings() *settings {
+	return c.current.Load().(*settings)
+}
+
+// Reload applies the reloadable settings of config, changes of the other
+// ones are only logged and need a restart
+func (c *Controller) Reload(config *elb_inject.Config) error {
+	if err := configfile.Validate(config); err != nil {
+		return err
+	}
+
+	old := c.settings()
+	merged, restart := configfile.Merge(old.Config, config)
+	if len(restart) > 0 {
+		klog.Warningf("[Config] restart to apply changes of %s", strings.Join(restart, ", "))
+	}
+
+	s, err := newSettings(merged, old)
+	if err != nil {
+		return err
+	}
+	// orphans only belong to the gc goroutine, keep counting their grace period
+	s.targetGC.orphans = old.targetGC.orphans
+	c.current.Store(s)
+	// queued and retried events of the old notifiers are sent before they stop
+	if s.notifier != old.notifier {
+		old.notifier.Close()
+	}
+	klog.Info("[Config] reloaded")
+
+	// pods of namespaces which just got selected
+	if !reflect.DeepEqual(old.ExcludeNamespaces, merged.ExcludeNamespaces) || old.NamespaceSelector != merged.NamespaceSelector {
+		c.enqueueAll()
+	}
+	return nil
+}
+
+func (c *Controller) enqueueAll() {
+	pods, err := c.podLister.List(labels.Everything())
+	if err != nil {
+		klog.Errorf("[Config] can not list pods: %v", err)
+		return
+	}
+	for _, po := range pods {
+		c.handleAddObject(po)
+	}
+}
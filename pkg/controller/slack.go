@@ -0,0 +1,134 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/zduymz/elb-inject/pkg/notify"
+)
+
+// slack interaction payloads are small
+const maxSlackRequestSize = 1 << 20
+
+// runSlackServer serves the slack callback until stopCh is closed. It has its
+// own listener, slack has to reach it but not the ledger and debug endpoints.
+func (c *Controller) runSlackServer(stopCh <-chan struct{}) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slack/actions", c.serveSlackAction)
+
+	config := c.settings()
+	server := &http.Server{
+		Addr:    config.SlackListenAddress,
+		Handler: mux,
+	}
+
+	go func() {
+		<-stopCh
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+	}()
+
+	klog.Infof("Starting slack callback server on %s", config.SlackListenAddress)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		klog.Errorf("Slack callback server stopped: %v", err)
+	}
+}
+
+// serveSlackAction handles the buttons of interactive slack notifiers, it is
+// the Interactivity Request URL of the slack app
+func (c *Controller) serveSlackAction(w http.ResponseWriter, r *http.Request) {
+	secretFile := c.settings().SlackSigningSecretFile
+	if secretFile == "" {
+		http.Error(w, "slack actions are disabled", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSlackRequestSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// read on every request, so a rotated secret needs no restart
+	secret, err := ioutil.ReadFile(secretFile)
+	if err != nil {
+		klog.Errorf("[Slack] can not read signing secret: %v", err)
+		http.Error(w, "can not read signing secret", http.StatusInternalServerError)
+		return
+	}
+	if err := notify.VerifySlackRequest([]byte(strings.TrimSpace(string(secret))), r.Header, body, time.Now()); err != nil {
+		klog.Warningf("[Slack] rejected request from %s: %v", r.RemoteAddr, err)
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	action, err := notify.ParseSlackAction(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if action.ActionID != notify.ActionRetryDeregistration {
+		// e.g. the console link
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	var value notify.RetryValue
+	if err := json.Unmarshal([]byte(action.Value), &value); err != nil || value.TargetGroup == "" {
+		http.Error(w, "invalid retry value", http.StatusBadRequest)
+		return
+	}
+
+	// slack wants an answer within 3 seconds
+	w.WriteHeader(http.StatusOK)
+	go func() {
+		text := c.retryDeregistration(action.User, value.TargetGroup, value.IPs)
+		if err := action.Reply(text); err != nil {
+			klog.Errorf("[Slack] can not reply to %s: %v", action.User, err)
+		}
+	}()
+}
+
+// retryDeregistration deregisters ips from targetGroup unless a live pod
+// got one of them meanwhile, and tells how it went
+func (c *Controller) retryDeregistration(user, targetGroup string, ips []string) string {
+	klog.Infof("[Slack] %s retries the deregistration of %v from [%s]", user, ips, targetGroup)
+
+	var lines []string
+	for _, ip := range ips {
+		if pod := c.targetInUse(targetGroup, ip, ""); pod != "" {
+			lines = append(lines, fmt.Sprintf("%s: skipped, used by %s", ip, pod))
+			continue
+		}
+
+		targetIP := ip
+		if err := c.provider.DeregisterIPFromTargetGroup(&targetGroup, &targetIP); err != nil {
+			klog.Errorf("[Slack] [%s] from [%s] failed. Reason: %v", ip, targetGroup, err)
+			lines = append(lines, fmt.Sprintf("%s: failed, %v", ip, err))
+			continue
+		}
+		klog.Infof("[Slack] [%s] from [%s] successfully", ip, targetGroup)
+		lines = append(lines, fmt.Sprintf("%s: deregistered", ip))
+		c.deregistrations.finish(deregisterKey{TargetGroup: targetGroup, IP: ip})
+
+		for _, entry := range c.ledger.ByTargetGroup(targetGroup) {
+			if entry.IP == ip {
+				c.forgetRegistration(entry.PodUID, entry.TargetGroup, entry.IP)
+			}
+		}
+	}
+
+	return fmt.Sprintf("%s retried the deregistration from %s:\n%s", user, targetGroup, strings.Join(lines, "\n"))
+}
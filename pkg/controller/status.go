@@ -0,0 +1,276 @@
+package controller
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+
+	"github.com/zduymz/elb-inject/pkg/ledger"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// registration is a pod address registered to a target group
+type registration struct {
+	TargetGroup string `json:"targetGroup"`
+	IP          string `json:"ip"`
+}
+
+const (
+	// DefaultAnnotationPrefix is the prefix of the annotations and the condition
+	DefaultAnnotationPrefix = "devops.apixio.com"
+
+	// inject a pod ip to this target group
+	suffixInject = "elb-inject-target-group-name"
+
+	// add to pod when injection is done
+	suffixStatus = "elb-inject-status"
+
+	// readiness gate, becomes True when the pod ip is registered
+	suffixRegistered = "elb-inject-registered"
+
+	// health of the pod targets, see runHealthCheck
+	suffixHealth  = "elb-inject-target-health"
+	suffixHealthy = "elb-inject-target-healthy"
+
+	// opt-in to remediation of unhealthy targets, see remediate
+	suffixRemediation      = "elb-inject-remediation"
+	suffixRemediationAfter = "elb-inject-remediation-after"
+
+	// healthy targets to keep in each target group of the pod, see delayDeregistration
+	suffixMinHealthy = "elb-inject-min-healthy-targets"
+
+	// label of a quarantined pod, it is kept out of its target groups
+	suffixQuarantined = "elb-inject-quarantined"
+
+	// opt-in to the preStop sleep of the webhook, see preStopContainersOf
+	suffixPreStopHook = "elb-inject-prestop-hook"
+)
+
+// keys are the annotation and condition names under one prefix. Keys under
+// a legacy prefix are still read, so pods annotated before a prefix change
+// keep working, their status moves to the new key on the next sync.
+type keys struct {
+	inject     string
+	status     string
+	registered corev1.PodConditionType
+	health     string
+	healthy    corev1.PodConditionType
+
+	remediation      string
+	remediationAfter string
+	quarantined      string
+	minHealthy       string
+	preStopHook      string
+
+	legacy []keys
+}
+
+func newKeys(prefix string, legacyPrefixes []string) keys {
+	k := keys{
+		inject:     prefix + "/" + suffixInject,
+		status:     prefix + "/" + suffixStatus,
+		registered: corev1.PodConditionType(prefix + "/" + suffixRegistered),
+		health:     prefix + "/" + suffixHealth,
+		healthy:    corev1.PodConditionType(prefix + "/" + suffixHealthy),
+
+		remediation:      prefix + "/" + suffixRemediation,
+		remediationAfter: prefix + "/" + suffixRemediationAfter,
+		quarantined:      prefix + "/" + suffixQuarantined,
+		minHealthy:       prefix + "/" + suffixMinHealthy,
+		preStopHook:      prefix + "/" + suffixPreStopHook,
+	}
+	for _, legacyPrefix := range legacyPrefixes {
+		if legacyPrefix != prefix {
+			k.legacy = append(k.legacy, newKeys(legacyPrefix, nil))
+		}
+	}
+	return k
+}
+
+// injectValue reads the inject annotation, the first legacy one when missing
+func (k keys) injectValue(po *corev1.Pod) string {
+	if value, ok := po.Annotations[k.inject]; ok {
+		return value
+	}
+	for _, l := range k.legacy {
+		if value, ok := po.Annotations[l.inject]; ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// statusValue reads the status annotation, the first legacy one when missing
+func (k keys) statusValue(po *corev1.Pod) string {
+	if value, ok := po.Annotations[k.status]; ok {
+		return value
+	}
+	for _, l := range k.legacy {
+		if value, ok := po.Annotations[l.status]; ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// hasLegacyStatus tells whether po still has a status under a legacy prefix
+func (k keys) hasLegacyStatus(po *corev1.Pod) bool {
+	for _, l := range k.legacy {
+		if _, ok := po.Annotations[l.status]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// readinessGateOf returns our readiness gate po has, new or legacy
+func (k keys) readinessGateOf(po *corev1.Pod) (corev1.PodConditionType, bool) {
+	if hasReadinessGate(po, k.registered) {
+		return k.registered, true
+	}
+	for _, l := range k.legacy {
+		if hasReadinessGate(po, l.registered) {
+			return l.registered, true
+		}
+	}
+	return "", false
+}
+
+// targetGroupsOf returns target groups po asks for in the inject annotation,
+// comma separated. A quarantined pod asks for none.
+func (k keys) targetGroupsOf(po *corev1.Pod) []string {
+	if _, ok := po.Labels[k.quarantined]; ok {
+		return nil
+	}
+
+	var targetGroups []string
+	for _, targetGroup := range strings.Split(k.injectValue(po), ",") {
+		targetGroup = strings.TrimSpace(targetGroup)
+		if targetGroup != "" && !containsString(targetGroups, targetGroup) {
+			targetGroups = append(targetGroups, targetGroup)
+		}
+	}
+	return targetGroups
+}
+
+func (k keys) isLegacyStatus(po *corev1.Pod) bool {
+	value := k.statusValue(po)
+	return value != "" && !strings.HasPrefix(value, "[")
+}
+
+// parseStatus reads the status annotation back into registrations.
+// Older versions only stored the pod ip, its target group is the inject annotation.
+func (k keys) parseStatus(po *corev1.Pod) []registration {
+	value := k.statusValue(po)
+	if value == "" {
+		return nil
+	}
+
+	if k.isLegacyStatus(po) {
+		targetGroup := strings.TrimSpace(k.injectValue(po))
+		if targetGroup == "" {
+			return nil
+		}
+		return []registration{{TargetGroup: targetGroup, IP: value}}
+	}
+
+	var registrations []registration
+	if err := json.Unmarshal([]byte(value), &registrations); err != nil {
+		return nil
+	}
+	return registrations
+}
+
+// registrationsOf returns the registrations of po. The status annotation is
+// never written in dry-run, what would have been written is kept in memory.
+func (c *Controller) registrationsOf(po *corev1.Pod) []registration {
+	if value, ok := c.dryRunStatus.Load(po.UID); ok {
+		return value.([]registration)
+	}
+	return c.keys.parseStatus(po)
+}
+
+// statusRewritePending tells whether the status of po still has to be moved
+// to the current format or key
+func (c *Controller) statusRewritePending(po *corev1.Pod) bool {
+	if _, ok := c.dryRunStatus.Load(po.UID); ok {
+		return false
+	}
+	return c.keys.isLegacyStatus(po) || c.keys.hasLegacyStatus(po)
+}
+
+func formatStatus(registrations []registration) string {
+	if len(registrations) == 0 {
+		return ""
+	}
+	value, _ := json.Marshal(registrations)
+	return string(value)
+}
+
+// podAddress picks the pod ip matching ipAddressType (ipv4 or ipv6)
+func podAddress(po *corev1.Pod, ipAddressType string) string {
+	ips := []string{po.Status.PodIP}
+	for _, podIP := range po.Status.PodIPs {
+		ips = append(ips, podIP.IP)
+	}
+
+	for _, ip := range ips {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			continue
+		}
+		isIPv4 := parsed.To4() != nil
+		if isIPv4 == (ipAddressType != "ipv6") {
+			return ip
+		}
+	}
+	return ""
+}
+
+func hasPodIP(po *corev1.Pod, ip string) bool {
+	if po.Status.PodIP == ip {
+		return true
+	}
+	for _, podIP := range po.Status.PodIPs {
+		if podIP.IP == ip {
+			return true
+		}
+	}
+	return false
+}
+
+func containsRegistration(registrations []registration, targetGroup string) bool {
+	for _, r := range registrations {
+		if r.TargetGroup == targetGroup {
+			return true
+		}
+	}
+	return false
+}
+
+func containsTarget(registrations []registration, targetGroup, ip string) bool {
+	for _, r := range registrations {
+		if r.TargetGroup == targetGroup && r.IP == ip {
+			return true
+		}
+	}
+	return false
+}
+
+func containsEntry(entries []ledger.Entry, targetGroup, ip string) bool {
+	for _, entry := range entries {
+		if entry.TargetGroup == targetGroup && entry.IP == ip {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,327 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog"
+
+	"github.com/zduymz/elb-inject/pkg/utils"
+)
+
+const (
+	webhookValidationReject = "reject"
+	webhookValidationWarn   = "warn"
+
+	// time left to the app to shutdown after preStop sleep
+	terminationGracePeriodBuffer int64 = 30
+)
+
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// runWebhookServer serves admission requests until stopCh is closed
+func (c *Controller) runWebhookServer(stopCh <-chan struct{}) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/validate", c.serveAdmission(c.validatePod))
+	mux.HandleFunc("/mutate", c.serveAdmission(c.mutatePod))
+
+	config := c.settings()
+	server := &http.Server{
+		Addr:    config.WebhookListenAddress,
+		Handler: mux,
+	}
+
+	go func() {
+		<-stopCh
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(ctx)
+	}()
+
+	klog.Infof("Starting admission webhook on %s", config.WebhookListenAddress)
+	if err := server.ListenAndServeTLS(config.WebhookCertFile, config.WebhookKeyFile); err != nil && err != http.ErrServerClosed {
+		klog.Errorf("Admission webhook stopped: %v", err)
+	}
+}
+
+type admitFunc func(*admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse
+
+// serveAdmission decodes an AdmissionReview, runs admit and writes the response back
+func (c *Controller) serveAdmission(admit admitFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		review := admissionv1.AdmissionReview{}
+		if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+			http.Error(w, "invalid admission review", http.StatusBadRequest)
+			return
+		}
+
+		response := admit(review.Request)
+		response.UID = review.Request.UID
+		review.Response = response
+		review.Request = nil
+
+		resp, err := json.Marshal(review)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(resp)
+	}
+}
+
+// validatePod rejects (or warns on) pods asking for a target group we can not register to
+func (c *Controller) validatePod(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	allowed := &admissionv1.AdmissionResponse{Allowed: true}
+
+	if req.Kind.Kind != "Pod" || req.Operation != admissionv1.Create {
+		return allowed
+	}
+
+	po := &corev1.Pod{}
+	if err := json.Unmarshal(req.Object.Raw, po); err != nil {
+		klog.Errorf("[Webhook] can not decode pod: %v", err)
+		return allowed
+	}
+	po.Namespace = req.Namespace
+
+	// the informer doesn't watch it
+	if !c.isNamespaceAllowed(po.Namespace) || !c.podSelector.Matches(labels.Set(po.Labels)) {
+		return allowed
+	}
+
+	var messages []string
+	for _, targetGroup := range c.keys.targetGroupsOf(po) {
+		if ok, reason := c.checkPolicy(po, targetGroup); !ok {
+			messages = append(messages, fmt.Sprintf("%s: target group %s denied by policy: %s", c.keys.inject, targetGroup, reason))
+			continue
+		}
+
+		err := c.provider.ValidateTargetGroup(targetGroup)
+		if err == nil {
+			continue
+		}
+
+		if errors.Is(err, utils.ErrNotFound) || errors.Is(err, utils.ErrInvalidTarget) {
+			messages = append(messages, fmt.Sprintf("%s: %v", c.keys.inject, err))
+			continue
+		}
+		// can not talk to aws, don't block anybody
+		klog.Errorf("[Webhook] can not validate target group %s: %v", targetGroup, err)
+	}
+
+	if _, _, err := c.keys.remediationOf(po, c.settings().RemediationUnhealthyAfter.Duration); err != nil {
+		messages = append(messages, err.Error())
+	}
+	if _, err := c.keys.minHealthyOf(po); err != nil {
+		messages = append(messages, err.Error())
+	}
+	if _, err := c.keys.preStopContainersOf(po); err != nil {
+		messages = append(messages, err.Error())
+	}
+
+	if len(messages) == 0 {
+		return allowed
+	}
+
+	msg := strings.Join(messages, "; ")
+	klog.Infof("[Webhook] pod %s/%s%s: %s", po.Namespace, po.Name, po.GenerateName, msg)
+	if c.settings().WebhookValidationMode == webhookValidationWarn {
+		allowed.Warnings = messages
+		return allowed
+	}
+
+	return &admissionv1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonInvalid,
+			Message: msg,
+			Code:    http.StatusUnprocessableEntity,
+		},
+	}
+}
+
+// mutatePod adds our readiness gate and, when enabled and the pod opted in, a
+// preStop sleep covering the deregistration delay
+func (c *Controller) mutatePod(req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	allowed := &admissionv1.AdmissionResponse{Allowed: true}
+
+	if req.Kind.Kind != "Pod" || req.Operation != admissionv1.Create {
+		return allowed
+	}
+
+	po := &corev1.Pod{}
+	if err := json.Unmarshal(req.Object.Raw, po); err != nil {
+		klog.Errorf("[Webhook] can not decode pod: %v", err)
+		return allowed
+	}
+	po.Namespace = req.Namespace
+
+	// the informer doesn't watch it
+	if !c.isNamespaceAllowed(po.Namespace) || !c.podSelector.Matches(labels.Set(po.Labels)) {
+		return allowed
+	}
+
+	targetGroups := c.keys.targetGroupsOf(po)
+	if len(targetGroups) == 0 {
+		return allowed
+	}
+
+	patches := readinessGatePatch(po, c.keys)
+
+	containers, err := c.keys.preStopContainersOf(po)
+	if err != nil {
+		klog.V(2).Infof("[Webhook] pod %s/%s%s: %v", po.Namespace, po.Name, po.GenerateName, err)
+	}
+	if c.settings().WebhookPreStopHook && len(containers) > 0 {
+		// cover the longest one
+		var delay int64
+		for _, targetGroup := range targetGroups {
+			d, err := c.provider.GetDeregistrationDelay(targetGroup)
+			if err != nil {
+				klog.Errorf("[Webhook] can not get deregistration delay of %s: %v", targetGroup, err)
+				continue
+			}
+			if d > delay {
+				delay = d
+			}
+		}
+		patches = append(patches, preStopPatch(po, delay, containers)...)
+	}
+
+	if len(patches) == 0 {
+		return allowed
+	}
+
+	patch, err := json.Marshal(patches)
+	if err != nil {
+		klog.Errorf("[Webhook] can not encode patch: %v", err)
+		return allowed
+	}
+
+	klog.V(4).Infof("[Webhook] patching pod %s/%s%s: %s", po.Namespace, po.Name, po.GenerateName, patch)
+	patchType := admissionv1.PatchTypeJSONPatch
+	allowed.Patch = patch
+	allowed.PatchType = &patchType
+	return allowed
+}
+
+func readinessGatePatch(po *corev1.Pod, k keys) []patchOperation {
+	if _, ok := k.readinessGateOf(po); ok {
+		return nil
+	}
+
+	gate := corev1.PodReadinessGate{ConditionType: k.registered}
+	if len(po.Spec.ReadinessGates) == 0 {
+		return []patchOperation{{Op: "add", Path: "/spec/readinessGates", Value: []corev1.PodReadinessGate{gate}}}
+	}
+	return []patchOperation{{Op: "add", Path: "/spec/readinessGates/-", Value: gate}}
+}
+
+// preStopContainersOf returns the containers po opted in to a preStop sleep
+// for: every one with "true", the listed ones with comma separated names.
+// The sleep runs in the container, an image without a sleep binary, e.g.
+// distroless, must be left out.
+func (k keys) preStopContainersOf(po *corev1.Pod) ([]string, error) {
+	value := strings.TrimSpace(po.Annotations[k.preStopHook])
+	switch value {
+	case "", "false":
+		return nil, nil
+	case "true":
+		var names []string
+		for _, container := range po.Spec.Containers {
+			names = append(names, container.Name)
+		}
+		return names, nil
+	}
+
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if !hasContainer(po, name) {
+			return nil, fmt.Errorf("%s: no container %q", k.preStopHook, name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func hasContainer(po *corev1.Pod, name string) bool {
+	for _, container := range po.Spec.Containers {
+		if container.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// preStopPatch adds a preStop sleep of delay seconds to containers
+func preStopPatch(po *corev1.Pod, delay int64, containers []string) []patchOperation {
+	var patches []patchOperation
+	if delay <= 0 || len(containers) == 0 {
+		return patches
+	}
+
+	preStop := &corev1.Handler{
+		Exec: &corev1.ExecAction{Command: []string{"sleep", fmt.Sprint(delay)}},
+	}
+
+	// don't touch containers which already have their own preStop
+	for i, container := range po.Spec.Containers {
+		if !containsString(containers, container.Name) {
+			continue
+		}
+		switch {
+		case container.Lifecycle == nil:
+			patches = append(patches, patchOperation{
+				Op:    "add",
+				Path:  fmt.Sprintf("/spec/containers/%d/lifecycle", i),
+				Value: &corev1.Lifecycle{PreStop: preStop},
+			})
+		case container.Lifecycle.PreStop == nil:
+			patches = append(patches, patchOperation{
+				Op:    "add",
+				Path:  fmt.Sprintf("/spec/containers/%d/lifecycle/preStop", i),
+				Value: preStop,
+			})
+		}
+	}
+
+	gracePeriod := int64(corev1.DefaultTerminationGracePeriodSeconds)
+	if po.Spec.TerminationGracePeriodSeconds != nil {
+		gracePeriod = *po.Spec.TerminationGracePeriodSeconds
+	}
+	if gracePeriod < delay+terminationGracePeriodBuffer {
+		patches = append(patches, patchOperation{
+			Op:    "add",
+			Path:  "/spec/terminationGracePeriodSeconds",
+			Value: delay + terminationGracePeriodBuffer,
+		})
+	}
+
+	return patches
+}
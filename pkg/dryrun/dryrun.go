@@ -0,0 +1,91 @@
+package dryrun
+
+import (
+	"sync"
+	"time"
+
+	"k8s.io/klog"
+
+	"github.com/zduymz/elb-inject/pkg/metrics"
+)
+
+const (
+	ActionRegister   = "register"
+	ActionDeregister = "deregister"
+	ActionClaim      = "claim"
+	ActionAnnotate   = "annotate"
+	ActionCondition  = "condition"
+	ActionAlert      = "alert"
+
+	// calls kept for the summary
+	recentCalls = 100
+)
+
+// Call is a mutation which was not made
+type Call struct {
+	Time        time.Time `json:"time"`
+	Action      string    `json:"action"`
+	TargetGroup string    `json:"targetGroup,omitempty"`
+	// ip or pod
+	Target string `json:"target"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Summary is what happened since start
+type Summary struct {
+	Since  time.Time      `json:"since"`
+	Counts map[string]int `json:"counts"`
+	Recent []Call         `json:"recent"`
+}
+
+// Recorder logs and counts the AWS and Kubernetes mutations skipped in
+// dry-run mode. A nil Recorder means mutations are made.
+type Recorder struct {
+	mu      sync.Mutex
+	started time.Time
+	counts  map[string]int
+	recent  []Call
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{
+		started: time.Now(),
+		counts:  make(map[string]int),
+	}
+}
+
+// Record notes a mutation instead of making it
+func (r *Recorder) Record(action, targetGroup, target, detail string) {
+	klog.Infof("[DryRun] would %s [%s] [%s] %s", action, target, targetGroup, detail)
+	metrics.DryRunCalls.WithLabelValues(action, targetGroup).Inc()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.counts[action]++
+	r.recent = append(r.recent, Call{
+		Time:        time.Now(),
+		Action:      action,
+		TargetGroup: targetGroup,
+		Target:      target,
+		Detail:      detail,
+	})
+	if len(r.recent) > recentCalls {
+		r.recent = r.recent[len(r.recent)-recentCalls:]
+	}
+}
+
+func (r *Recorder) Summary() Summary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	counts := make(map[string]int, len(r.counts))
+	for action, n := range r.counts {
+		counts[action] = n
+	}
+	return Summary{
+		Since:  r.started,
+		Counts: counts,
+		Recent: append([]Call(nil), r.recent...),
+	}
+}
@@ -0,0 +1,318 @@
+package ledger
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog"
+)
+
+// Entry is a pod ip elb-inject registered to a target group
+type Entry struct {
+	PodUID         string    `json:"podUID"`
+	Namespace      string    `json:"namespace"`
+	Pod            string    `json:"pod"`
+	IP             string    `json:"ip"`
+	Port           int64     `json:"port,omitempty"`
+	TargetGroup    string    `json:"targetGroup"`
+	TargetGroupARN string    `json:"targetGroupARN"`
+	Time           time.Time `json:"time"`
+}
+
+// shards is the number of ConfigMaps the ledger is spread over, a ConfigMap
+// holds at most 1MiB, a few thousand pods
+const shards = 16
+
+// Ledger keeps every registration in ConfigMaps, one key per pod uid. Pods
+// are spread over shards ConfigMaps by a hash of their uid.
+// It does not depend on pod annotations, so a stripped annotation or a missed
+// delete event doesn't leave a target behind.
+type Ledger struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	// keep entries in memory only, see SetReadOnly
+	readOnly bool
+
+	// guards entries only, readers never wait for the api server
+	mu      sync.Mutex
+	entries map[string][]Entry
+	// writes of a shard run one at a time
+	shardMu [shards]sync.Mutex
+}
+
+func NewLedger(client kubernetes.Interface, namespace, name string) *Ledger {
+	return &Ledger{
+		client:    client,
+		namespace: namespace,
+		name:      name,
+		entries:   make(map[string][]Entry),
+	}
+}
+
+// SetReadOnly keeps changes in memory, the ConfigMaps are only read. Used by
+// dry-run, which must not touch what a live instance relies on.
+func (l *Ledger) SetReadOnly(readOnly bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.readOnly = readOnly
+}
+
+// shardOf returns the shard keeping podUID
+func shardOf(podUID string) int {
+	h := fnv.New32a()
+	h.Write([]byte(podUID))
+	return int(h.Sum32() % shards)
+}
+
+// shardName returns the ConfigMap name of shard
+func (l *Ledger) shardName(shard int) string {
+	return fmt.Sprintf("%s-%d", l.name, shard)
+}
+
+// Load reads every shard, a missing one is created on the first write.
+// Entries of the single ConfigMap older versions kept are moved to the
+// shards.
+func (l *Ledger) Load() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := make(map[string][]Entry)
+	for shard := 0; shard < shards; shard++ {
+		if _, err := l.read(l.shardName(shard), entries); err != nil {
+			return err
+		}
+	}
+
+	legacy := make(map[string][]Entry)
+	found, err := l.read(l.name, legacy)
+	if err != nil {
+		return err
+	}
+	for uid, podEntries := range legacy {
+		entries[uid] = podEntries
+	}
+	l.entries = entries
+
+	if found && !l.readOnly {
+		if err := l.migrate(legacy); err != nil {
+			return fmt.Errorf("can not move ledger %s/%s to shards: %v", l.namespace, l.name, err)
+		}
+	}
+	klog.Infof("Loaded %d pods from ledger %s/%s", len(entries), l.namespace, l.name)
+	return nil
+}
+
+// read decodes the entries of ConfigMap name into entries, tells whether it exists
+func (l *Ledger) read(name string, entries map[string][]Entry) (bool, error) {
+	cm, err := l.client.CoreV1().ConfigMaps(l.namespace).Get(context.Background(), name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	for uid, value := range cm.Data {
+		var podEntries []Entry
+		if err := json.Unmarshal([]byte(value), &podEntries); err != nil {
+			klog.Errorf("Ledger: can not decode entries of %s: %v", uid, err)
+			continue
+		}
+		entries[uid] = podEntries
+	}
+	return true, nil
+}
+
+// migrate writes legacy entries to their shards and deletes the ConfigMap
+// older versions kept, l.mu must be held
+func (l *Ledger) migrate(legacy map[string][]Entry) error {
+	values := make(map[int]map[string]string)
+	for uid, podEntries := range legacy {
+		data, err := json.Marshal(podEntries)
+		if err != nil {
+			return err
+		}
+		shard := shardOf(uid)
+		if values[shard] == nil {
+			values[shard] = make(map[string]string)
+		}
+		values[shard][uid] = string(data)
+	}
+	for shard, shardValues := range values {
+		if err := l.update(shard, shardValues); err != nil {
+			return err
+		}
+	}
+
+	klog.Infof("Moved %d pods of ledger %s/%s to %d shards", len(legacy), l.namespace, l.name, shards)
+	err := l.client.CoreV1().ConfigMaps(l.namespace).Delete(context.Background(), l.name, metav1.DeleteOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// Record adds entry, replacing the one with the same pod uid, target group and ip
+func (l *Ledger) Record(entry Entry) error {
+	l.mu.Lock()
+
+	podEntries := removeEntry(l.entries[entry.PodUID], entry.TargetGroup, entry.IP)
+	l.entries[entry.PodUID] = append(podEntries, entry)
+	l.mu.Unlock()
+
+	return l.save(entry.PodUID)
+}
+
+// Remove drops the entry of podUID, targetGroup and ip
+func (l *Ledger) Remove(podUID, targetGroup, ip string) error {
+	l.mu.Lock()
+	podEntries, ok := l.entries[podUID]
+	if !ok {
+		l.mu.Unlock()
+		return nil
+	}
+
+	podEntries = removeEntry(podEntries, targetGroup, ip)
+	if len(podEntries) == 0 {
+		delete(l.entries, podUID)
+	} else {
+		l.entries[podUID] = podEntries
+	}
+	l.mu.Unlock()
+
+	return l.save(podUID)
+}
+
+// ByPod returns entries of podUID
+func (l *Ledger) ByPod(podUID string) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return append([]Entry(nil), l.entries[podUID]...)
+}
+
+// ByTargetGroup returns entries registered to targetGroup, all when empty
+func (l *Ledger) ByTargetGroup(targetGroup string) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var result []Entry
+	for _, podEntries := range l.entries {
+		for _, entry := range podEntries {
+			if targetGroup == "" || entry.TargetGroup == targetGroup || entry.TargetGroupARN == targetGroup {
+				result = append(result, entry)
+			}
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Time.Before(result[j].Time)
+	})
+	return result
+}
+
+// PodUIDs returns uid of every pod in the ledger
+func (l *Ledger) PodUIDs() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var uids []string
+	for uid := range l.entries {
+		uids = append(uids, uid)
+	}
+	return uids
+}
+
+// save writes the entries podUID has now to its shard. They are read under
+// the shard lock, the last write of a pod always has its latest entries.
+func (l *Ledger) save(podUID string) error {
+	shard := shardOf(podUID)
+	l.shardMu[shard].Lock()
+	defer l.shardMu[shard].Unlock()
+
+	l.mu.Lock()
+	readOnly := l.readOnly
+	podEntries, ok := l.entries[podUID]
+	var data []byte
+	var err error
+	if ok {
+		data, err = json.Marshal(podEntries)
+	}
+	l.mu.Unlock()
+
+	if readOnly || err != nil {
+		return err
+	}
+	return l.update(shard, map[string]string{podUID: string(data)})
+}
+
+// update sets the pod uid keys of shard to values, an empty value removes
+// the key. The shard is created when missing.
+func (l *Ledger) update(shard int, values map[string]string) error {
+	name := l.shardName(shard)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		ctx := context.Background()
+		cm, err := l.client.CoreV1().ConfigMaps(l.namespace).Get(ctx, name, metav1.GetOptions{})
+		created := errors.IsNotFound(err)
+		if created {
+			cm, err = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: l.namespace, Name: name}}, nil
+		}
+		if err != nil {
+			return err
+		}
+
+		changed := false
+		for podUID, value := range values {
+			if value == "" {
+				if _, ok := cm.Data[podUID]; ok {
+					delete(cm.Data, podUID)
+					changed = true
+				}
+				continue
+			}
+			if cm.Data == nil {
+				cm.Data = make(map[string]string)
+			}
+			cm.Data[podUID] = value
+			changed = true
+		}
+
+		switch {
+		case !changed:
+			return nil
+		case created:
+			klog.Infof("Creating ledger %s/%s", l.namespace, name)
+			_, err = l.client.CoreV1().ConfigMaps(l.namespace).Create(ctx, cm, metav1.CreateOptions{})
+			// created meanwhile, update it instead
+			if errors.IsAlreadyExists(err) {
+				err = errors.NewConflict(corev1.Resource("configmaps"), name, err)
+			}
+		default:
+			_, err = l.client.CoreV1().ConfigMaps(l.namespace).Update(ctx, cm, metav1.UpdateOptions{})
+		}
+		return err
+	})
+}
+
+func removeEntry(entries []Entry, targetGroup, ip string) []Entry {
+	var result []Entry
+	for _, entry := range entries {
+		if entry.TargetGroup == targetGroup && entry.IP == ip {
+			continue
+		}
+		result = append(result, entry)
+	}
+	return result
+}
@@ -0,0 +1,117 @@
+package ledger
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestLedger(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	l := NewLedger(client, "default", "elb-inject-ledger")
+	assert.Nil(t, l.Load())
+
+	now := time.Now()
+	assert.Nil(t, l.Record(Entry{PodUID: "uid-1", Pod: "foo", IP: "10.0.0.1", TargetGroup: "tg-a", Time: now}))
+	assert.Nil(t, l.Record(Entry{PodUID: "uid-1", Pod: "foo", IP: "10.0.0.1", TargetGroup: "tg-b", Time: now}))
+	assert.Nil(t, l.Record(Entry{PodUID: "uid-2", Pod: "bar", IP: "10.0.0.2", TargetGroup: "tg-a", TargetGroupARN: "arn-a", Time: now}))
+	// same target again only replaces it
+	assert.Nil(t, l.Record(Entry{PodUID: "uid-1", Pod: "foo", IP: "10.0.0.1", TargetGroup: "tg-a", Time: now}))
+
+	assert.Equal(t, 2, len(l.ByPod("uid-1")))
+	assert.Equal(t, 2, len(l.ByTargetGroup("tg-a")))
+	assert.Equal(t, 1, len(l.ByTargetGroup("arn-a")))
+	assert.Equal(t, 3, len(l.ByTargetGroup("")))
+
+	// survives a restart
+	reloaded := NewLedger(client, "default", "elb-inject-ledger")
+	assert.Nil(t, reloaded.Load())
+	assert.Equal(t, 2, len(reloaded.ByPod("uid-1")))
+
+	assert.Nil(t, l.Remove("uid-1", "tg-a", "10.0.0.1"))
+	assert.Nil(t, l.Remove("uid-1", "tg-b", "10.0.0.1"))
+	assert.Equal(t, 0, len(l.ByPod("uid-1")))
+	assert.Equal(t, []string{"uid-2"}, l.PodUIDs())
+
+	cm, _ := client.CoreV1().ConfigMaps("default").Get(context.Background(), l.shardName(shardOf("uid-1")), metav1.GetOptions{})
+	_, found := cm.Data["uid-1"]
+	assert.False(t, found)
+	cm, _ = client.CoreV1().ConfigMaps("default").Get(context.Background(), l.shardName(shardOf("uid-2")), metav1.GetOptions{})
+	_, found = cm.Data["uid-2"]
+	assert.True(t, found)
+}
+
+func TestLedgerMigrate(t *testing.T) {
+	// what older versions wrote
+	client := fake.NewSimpleClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "elb-inject-ledger"},
+		Data: map[string]string{
+			"uid-1": `[{"podUID":"uid-1","pod":"foo","ip":"10.0.0.1","targetGroup":"tg-a"}]`,
+			"uid-2": `[{"podUID":"uid-2","pod":"bar","ip":"10.0.0.2","targetGroup":"tg-a"}]`,
+		},
+	})
+	l := NewLedger(client, "default", "elb-inject-ledger")
+	assert.Nil(t, l.Load())
+	assert.Equal(t, 2, len(l.ByTargetGroup("tg-a")))
+
+	_, err := client.CoreV1().ConfigMaps("default").Get(context.Background(), "elb-inject-ledger", metav1.GetOptions{})
+	assert.True(t, errors.IsNotFound(err))
+
+	reloaded := NewLedger(client, "default", "elb-inject-ledger")
+	assert.Nil(t, reloaded.Load())
+	assert.Equal(t, 2, len(reloaded.ByTargetGroup("tg-a")))
+}
+
+func TestLedgerReadOnly(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	l := NewLedger(client, "default", "elb-inject-ledger")
+	l.SetReadOnly(true)
+	assert.Nil(t, l.Load())
+
+	assert.Nil(t, l.Record(Entry{PodUID: "uid-1", Pod: "foo", IP: "10.0.0.1", TargetGroup: "tg-a", Time: time.Now()}))
+	assert.Equal(t, 1, len(l.ByPod("uid-1")))
+
+	cms, err := client.CoreV1().ConfigMaps("default").List(context.Background(), metav1.ListOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(cms.Items))
+}
+
+func TestLedgerReadDuringWrite(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	l := NewLedger(client, "default", "elb-inject-ledger")
+	assert.Nil(t, l.Load())
+	assert.Nil(t, l.Record(Entry{PodUID: "uid-1", Pod: "foo", IP: "10.0.0.1", TargetGroup: "tg-a"}))
+
+	// the api server hangs on the next write
+	release := make(chan struct{})
+	client.PrependReactor("get", "configmaps", func(k8stesting.Action) (bool, runtime.Object, error) {
+		<-release
+		return false, nil, nil
+	})
+	done := make(chan error)
+	go func() {
+		done <- l.Record(Entry{PodUID: "uid-2", Pod: "bar", IP: "10.0.0.2", TargetGroup: "tg-a"})
+	}()
+
+	read := make(chan int)
+	go func() {
+		read <- len(l.ByPod("uid-1"))
+	}()
+	select {
+	case n := <-read:
+		assert.Equal(t, 1, n)
+	case <-time.After(5 * time.Second):
+		t.Fatal("read waited for the write")
+	}
+
+	close(release)
+	assert.Nil(t, <-done)
+}
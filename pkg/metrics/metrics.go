@@ -0,0 +1,92 @@
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "elb_inject"
+
+var (
+	// PolicyDenied counts pods denied to use a target group by the policy
+	PolicyDenied = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "policy_denied_total",
+		Help:      "Number of times a pod was denied to use a target group by the policy.",
+	}, []string{"namespace", "target_group"})
+
+	// DryRunCalls counts mutations skipped in dry-run mode
+	DryRunCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "dry_run_calls_total",
+		Help:      "Number of AWS and Kubernetes mutations skipped in dry-run mode.",
+	}, []string{"action", "target_group"})
+
+	// AlertsSent counts notifications sent by type
+	AlertsSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "alerts_sent_total",
+		Help:      "Number of alerts sent to the notifiers.",
+	}, []string{"type"})
+
+	// AlertsSuppressed counts alerts dropped as duplicates
+	AlertsSuppressed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "alerts_suppressed_total",
+		Help:      "Number of alerts dropped because a similar one was sent recently.",
+	}, []string{"type"})
+
+	// DeregisterFailures counts failed attempts of queued deregistrations
+	DeregisterFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deregister_failures_total",
+		Help:      "Number of failed attempts to deregister a target of a deleted pod.",
+	}, []string{"target_group"})
+
+	// TargetGroupCacheRefreshes counts DescribeTargetGroups of the target group cache
+	TargetGroupCacheRefreshes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "target_group_cache_refreshes_total",
+		Help:      "Number of target group cache refreshes by trigger (init, interval, miss) and result.",
+	}, []string{"trigger", "result"})
+
+	// TargetGroupCacheAge is the time since the target groups were described
+	TargetGroupCacheAge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "target_group_cache_age_seconds",
+		Help:      "Seconds since the target group cache was last refreshed.",
+	}, func() float64 {
+		if age, ok := targetGroupCacheAge.Load().(func() time.Duration); ok {
+			return age().Seconds()
+		}
+		return 0
+	})
+
+	// Targets counts the targets we registered by health, set by the health watcher
+	Targets = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "targets",
+		Help:      "Number of targets registered by elb-inject by target group, health state and reason.",
+	}, []string{"target_group", "state", "reason"})
+
+	// Remediations counts pods quarantined or evicted for unhealthy targets
+	Remediations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "remediations_total",
+		Help:      "Number of pods quarantined or evicted because a target stayed unhealthy, by action and result.",
+	}, []string{"action", "result"})
+
+	// func() time.Duration
+	targetGroupCacheAge atomic.Value
+)
+
+// SetTargetGroupCacheAge sets what TargetGroupCacheAge reports
+func SetTargetGroupCacheAge(age func() time.Duration) {
+	targetGroupCacheAge.Store(age)
+}
+
+func init() {
+	prometheus.MustRegister(PolicyDenied, DryRunCalls, AlertsSent, AlertsSuppressed, DeregisterFailures, TargetGroupCacheRefreshes, TargetGroupCacheAge, Targets, Remediations)
+}
@@ -0,0 +1,135 @@
+package notify
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pods listed in a summary, the others are counted
+const summaryMaxLines = 20
+
+// aggregator groups events by type, target group and reason within a window,
+// a node drain failing a hundred deregistrations sends one message
+type aggregator struct {
+	window time.Duration
+	send   func(Event)
+
+	mu      sync.Mutex
+	batches map[string][]Event
+	closed  bool
+}
+
+func batchKey(event Event) string {
+	return event.Type + "/" + event.TargetGroup + "/" + event.Reason
+}
+
+func (a *aggregator) add(event Event) {
+	if a.window <= 0 {
+		a.send(event)
+		return
+	}
+
+	key := batchKey(event)
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		a.send(event)
+		return
+	}
+	batch, ok := a.batches[key]
+	a.batches[key] = append(batch, event)
+	a.mu.Unlock()
+
+	// the first event of a batch starts the window
+	if !ok {
+		time.AfterFunc(a.window, func() { a.flush(key) })
+	}
+}
+
+func (a *aggregator) flush(key string) {
+	a.mu.Lock()
+	batch := a.batches[key]
+	delete(a.batches, key)
+	a.mu.Unlock()
+
+	if len(batch) > 0 {
+		a.send(summarize(batch))
+	}
+}
+
+// close sends every pending batch, later events are sent right away
+func (a *aggregator) close() {
+	a.mu.Lock()
+	a.closed = true
+	var keys []string
+	for key := range a.batches {
+		keys = append(keys, key)
+	}
+	a.mu.Unlock()
+
+	for _, key := range keys {
+		a.flush(key)
+	}
+}
+
+// summarize turns a batch into one event
+func summarize(batch []Event) Event {
+	if len(batch) == 1 {
+		return batch[0]
+	}
+
+	first := batch[0]
+	summary := Event{
+		Type:           first.Type,
+		TargetGroup:    first.TargetGroup,
+		TargetGroupARN: first.TargetGroupARN,
+		Reason:         first.Reason,
+		Time:           first.Time,
+	}
+
+	var namespaces, ips, lines []string
+	for i, event := range batch {
+		if !containsString(namespaces, event.Namespace) {
+			namespaces = append(namespaces, event.Namespace)
+		}
+		if event.IP != "" && !containsString(ips, event.IP) {
+			ips = append(ips, event.IP)
+		}
+		if i < summaryMaxLines {
+			lines = append(lines, "- "+event.Message)
+		}
+	}
+	if len(batch) > summaryMaxLines {
+		lines = append(lines, fmt.Sprintf("- ... and %d more", len(batch)-summaryMaxLines))
+	}
+	summary.IPs = ips
+	if len(namespaces) == 1 {
+		summary.Namespace = namespaces[0]
+	}
+
+	summary.Message = fmt.Sprintf("%d x %s on %s", len(batch), first.Type, first.TargetGroup)
+	if first.Reason != "" {
+		summary.Message += fmt.Sprintf(" (%s)", first.Reason)
+	}
+	summary.Message += ":\n" + strings.Join(lines, "\n")
+
+	if first.Type == EventDeregisterFailed && first.TargetGroupARN != "" && len(ips) > 0 {
+		sort.Strings(ips)
+		summary.Detail = fmt.Sprintf("aws elbv2 deregister-targets --target-group-arn %s --targets Id=%s", first.TargetGroupARN, strings.Join(ips, " Id="))
+	} else {
+		summary.Detail = first.Detail
+	}
+	return summary
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
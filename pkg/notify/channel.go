@@ -0,0 +1,125 @@
+package notify
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/time/rate"
+	"k8s.io/klog"
+)
+
+const (
+	defaultRatePerMinute = 20
+	defaultRetries       = 3
+	retryBackoff         = 30 * time.Second
+	queueSize            = 100
+)
+
+type delivery struct {
+	event    Event
+	attempts int
+}
+
+// channel delivers events to one notifier, one at a time, at most
+// RatePerMinute of them and retries failures with a growing backoff
+type channel struct {
+	name     string
+	notifier Notifier
+	routes   []Route
+	limiter  *rate.Limiter
+	retries  int
+	backoff  time.Duration
+
+	queue chan delivery
+	ctx   context.Context
+}
+
+func newChannel(ctx context.Context, name string, notifier Notifier, config Config) *channel {
+	perMinute := config.RatePerMinute
+	if perMinute == 0 {
+		perMinute = defaultRatePerMinute
+	}
+	retries := config.Retries
+	if retries == 0 {
+		retries = defaultRetries
+	}
+
+	return &channel{
+		name:     name,
+		notifier: notifier,
+		routes:   config.Routes,
+		limiter:  rate.NewLimiter(rate.Limit(float64(perMinute)/60), perMinute),
+		retries:  retries,
+		backoff:  retryBackoff,
+		queue:    make(chan delivery, queueSize),
+		ctx:      ctx,
+	}
+}
+
+func (ch *channel) wants(event Event) bool {
+	if len(ch.routes) == 0 {
+		return true
+	}
+	for _, route := range ch.routes {
+		if route.matches(event) {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueue never blocks, an event is dropped when the queue is full or the
+// channel was closed and nothing reads the queue anymore
+func (ch *channel) enqueue(d delivery) {
+	if ch.ctx.Err() != nil {
+		klog.Errorf("[Notify] %s is closed, dropping %s: %s", ch.name, d.event.Title(), d.event.Message)
+		return
+	}
+	select {
+	case ch.queue <- d:
+	default:
+		klog.Errorf("[Notify] %s queue is full, dropping %s: %s", ch.name, d.event.Title(), d.event.Message)
+	}
+}
+
+// run sends queued events until ctx is done and the queue is empty
+func (ch *channel) run() {
+	for {
+		select {
+		case d := <-ch.queue:
+			ch.send(d)
+		case <-ch.ctx.Done():
+			// drain what is left, without retries
+			for {
+				select {
+				case d := <-ch.queue:
+					d.attempts = ch.retries
+					ch.send(d)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (ch *channel) send(d delivery) {
+	// a cancelled ctx doesn't wait for the limiter
+	_ = ch.limiter.Wait(ch.ctx)
+
+	err := ch.notifier.Notify(d.event)
+	if err == nil {
+		return
+	}
+
+	d.attempts++
+	if d.attempts > ch.retries || ch.ctx.Err() != nil {
+		klog.Errorf("[Notify] %s can not send %s, giving up: %v", ch.name, d.event.Title(), err)
+		klog.Error(d.event.Message)
+		return
+	}
+
+	backoff := ch.backoff * time.Duration(d.attempts)
+	klog.Warningf("[Notify] %s can not send %s, retrying in %s: %v", ch.name, d.event.Title(), backoff, err)
+	time.AfterFunc(backoff, func() { ch.enqueue(d) })
+}
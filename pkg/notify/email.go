@@ -0,0 +1,125 @@
+package notify
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Email sends a plain text mail through an SMTP server
+type Email struct {
+	Addr         string
+	Username     string
+	PasswordFile string
+	From         string
+	To           []string
+	// bounds the whole conversation with the server
+	Timeout time.Duration
+}
+
+func newEmail(config Config) (*Email, error) {
+	if config.SMTPHost == "" || config.From == "" || len(config.To) == 0 {
+		return nil, fmt.Errorf("email: smtpHost, from and to are required")
+	}
+
+	port := config.SMTPPort
+	if port == 0 {
+		port = 587
+	}
+	return &Email{
+		Addr:         net.JoinHostPort(config.SMTPHost, strconv.Itoa(port)),
+		Username:     config.Username,
+		PasswordFile: config.PasswordFile,
+		From:         config.From,
+		To:           config.To,
+		Timeout:      sendTimeout,
+	}, nil
+}
+
+func (e *Email) Notify(event Event) error {
+	var auth smtp.Auth
+	if e.Username != "" {
+		// read on every send, so a rotated secret is picked up
+		password, err := ioutil.ReadFile(e.PasswordFile)
+		if err != nil {
+			return err
+		}
+		host, _, _ := net.SplitHostPort(e.Addr)
+		auth = smtp.PlainAuth("", e.Username, strings.TrimSpace(string(password)), host)
+	}
+	return e.send(auth, e.message(event))
+}
+
+// send is smtp.SendMail bounded by Timeout, a server which stops answering
+// doesn't hang the channel
+func (e *Email) send(auth smtp.Auth, msg []byte) error {
+	conn, err := net.DialTimeout("tcp", e.Addr, e.Timeout)
+	if err != nil {
+		return err
+	}
+	if err := conn.SetDeadline(time.Now().Add(e.Timeout)); err != nil {
+		conn.Close()
+		return err
+	}
+
+	host, _, _ := net.SplitHostPort(e.Addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fmt.Errorf("email: %s doesn't support AUTH", e.Addr)
+		}
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(e.From); err != nil {
+		return err
+	}
+	for _, to := range e.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func (e *Email) message(event Event) []byte {
+	msg := &bytes.Buffer{}
+	fmt.Fprintf(msg, "From: %s\r\n", e.From)
+	fmt.Fprintf(msg, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(msg, "Subject: %s\r\n", event.Title())
+	fmt.Fprintf(msg, "Date: %s\r\n", event.Time.Format("Mon, 02 Jan 2006 15:04:05 -0700"))
+	fmt.Fprintf(msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(msg, "%s\r\n", event.Message)
+	if event.Detail != "" {
+		fmt.Fprintf(msg, "\r\n%s\r\n", event.Detail)
+	}
+	return msg.Bytes()
+}
@@ -0,0 +1,241 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"time"
+)
+
+// Event types
+const (
+	// a target could not be removed from its target group
+	EventDeregisterFailed = "DeregisterFailed"
+	// a pod failed several times in a row to register, or was rejected
+	EventRegisterFailed = "RegisterFailed"
+	// a pod asks for a target group which doesn't exist
+	EventUnknownTargetGroup = "UnknownTargetGroup"
+	// a running pod is still not registered
+	EventPodStuck = "PodStuck"
+	// a registered target stays unhealthy
+	EventTargetUnhealthy = "TargetUnhealthy"
+)
+
+const (
+	TypeSlack   = "slack"
+	TypeTeams   = "teams"
+	TypeWebhook = "webhook"
+	TypeEmail   = "email"
+
+	sendTimeout = 10 * time.Second
+)
+
+// Event is something a human should know about
+type Event struct {
+	Type        string `json:"type"`
+	Namespace   string `json:"namespace,omitempty"`
+	Pod         string `json:"pod,omitempty"`
+	TargetGroup string `json:"targetGroup,omitempty"`
+	IP          string `json:"ip,omitempty"`
+	// every ip of a summary
+	IPs     []string `json:"ips,omitempty"`
+	Message string   `json:"message"`
+	// error class, events are batched by type, target group and reason
+	Reason         string `json:"reason,omitempty"`
+	TargetGroupARN string `json:"targetGroupARN,omitempty"`
+	// e.g. the command fixing it by hand
+	Detail string    `json:"detail,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// Title is a one line summary of the event
+func (e Event) Title() string {
+	if e.Pod == "" {
+		return fmt.Sprintf("[elb-inject] %s %s", e.Type, e.TargetGroup)
+	}
+	return fmt.Sprintf("[elb-inject] %s %s/%s", e.Type, e.Namespace, e.Pod)
+}
+
+// Notifier sends an event somewhere
+type Notifier interface {
+	Notify(event Event) error
+}
+
+// Route selects events by type, namespace and target group. Empty lists
+// match everything, namespaces and target groups are path.Match patterns.
+type Route struct {
+	Events       []string `json:"events,omitempty"`
+	Namespaces   []string `json:"namespaces,omitempty"`
+	TargetGroups []string `json:"targetGroups,omitempty"`
+}
+
+func (r Route) matches(event Event) bool {
+	return matchAny(r.Events, event.Type) && matchAny(r.Namespaces, event.Namespace) && matchAny(r.TargetGroups, event.TargetGroup)
+}
+
+// Config describes one notifier
+type Config struct {
+	// shows in logs, defaults to the type
+	Name string `json:"name,omitempty"`
+	// slack, teams, webhook or email
+	Type string `json:"type"`
+	// incoming webhook of slack, teams or webhook
+	URL string `json:"url,omitempty"`
+	// slack only, add a retry button to failed deregistrations
+	Interactive bool `json:"interactive,omitempty"`
+
+	// webhook only, Body is a text/template of the request body executed
+	// with the Event, the Event as json when empty
+	Method  string            `json:"method,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+
+	// email only
+	SMTPHost     string   `json:"smtpHost,omitempty"`
+	SMTPPort     int      `json:"smtpPort,omitempty"`
+	Username     string   `json:"username,omitempty"`
+	PasswordFile string   `json:"passwordFile,omitempty"`
+	From         string   `json:"from,omitempty"`
+	To           []string `json:"to,omitempty"`
+
+	// the notifier gets an event matching any route, every event when empty
+	Routes []Route `json:"routes,omitempty"`
+
+	// messages sent per minute, 20 when 0
+	RatePerMinute int `json:"ratePerMinute,omitempty"`
+	// attempts after a failed send, 3 when 0
+	Retries int `json:"retries,omitempty"`
+}
+
+// New builds the notifier of config
+func New(config Config) (Notifier, error) {
+	switch config.Type {
+	case TypeSlack:
+		return newSlack(config)
+	case TypeTeams:
+		return newTeams(config)
+	case TypeWebhook:
+		return newWebhook(config)
+	case TypeEmail:
+		return newEmail(config)
+	}
+	return nil, fmt.Errorf("unknown notifier type %q", config.Type)
+}
+
+// Validate checks configs without building anything
+func Validate(configs []Config) error {
+	for i, config := range configs {
+		if _, err := New(config); err != nil {
+			return fmt.Errorf("notifier %d: %v", i, err)
+		}
+		if config.RatePerMinute < 0 || config.Retries < 0 {
+			return fmt.Errorf("notifier %d: ratePerMinute and retries must not be negative", i)
+		}
+		for j, route := range config.Routes {
+			for _, pattern := range append(append([]string{}, route.Namespaces...), route.TargetGroups...) {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("notifier %d: route %d: invalid pattern %q: %v", i, j, pattern, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Dispatcher batches events and hands them to every channel routing them
+type Dispatcher struct {
+	channels   []*channel
+	aggregator *aggregator
+	cancel     context.CancelFunc
+}
+
+// NewDispatcher starts a channel per config, events are batched within
+// aggregateWindow, sent right away when 0
+func NewDispatcher(configs []Config, aggregateWindow time.Duration) (*Dispatcher, error) {
+	if err := Validate(configs); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &Dispatcher{cancel: cancel}
+	for _, config := range configs {
+		notifier, _ := New(config)
+		name := config.Name
+		if name == "" {
+			name = config.Type
+		}
+		ch := newChannel(ctx, name, notifier, config)
+		go ch.run()
+		d.channels = append(d.channels, ch)
+	}
+
+	d.aggregator = &aggregator{
+		window:  aggregateWindow,
+		send:    d.dispatch,
+		batches: make(map[string][]Event),
+	}
+	return d, nil
+}
+
+// Notify queues event, it never blocks
+func (d *Dispatcher) Notify(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	d.aggregator.add(event)
+}
+
+// Close sends pending batches, what is queued is sent without retries
+func (d *Dispatcher) Close() {
+	d.aggregator.close()
+	d.cancel()
+}
+
+func (d *Dispatcher) dispatch(event Event) {
+	for _, ch := range d.channels {
+		if ch.wants(event) {
+			ch.enqueue(delivery{event: event})
+		}
+	}
+}
+
+func matchAny(patterns []string, s string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// post sends body and fails on a non 2xx response
+func post(method, url string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	client := &http.Client{Timeout: sendTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s", resp.Status, msg)
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+package notify
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoute(t *testing.T) {
+	event := Event{Type: EventDeregisterFailed, Namespace: "team-a", TargetGroup: "team-a-web"}
+
+	assert.True(t, Route{}.matches(event))
+	assert.True(t, Route{Events: []string{EventDeregisterFailed}, Namespaces: []string{"team-*"}}.matches(event))
+	assert.False(t, Route{Events: []string{"Other"}}.matches(event))
+	assert.False(t, Route{TargetGroups: []string{"team-b-*"}}.matches(event))
+
+	ch := channel{routes: []Route{{Namespaces: []string{"team-b"}}, {TargetGroups: []string{"team-a-*"}}}}
+	assert.True(t, ch.wants(event))
+}
+
+func TestValidate(t *testing.T) {
+	assert.NotNil(t, Validate([]Config{{Type: "pager"}}))
+	assert.NotNil(t, Validate([]Config{{Type: TypeSlack}}))
+	assert.NotNil(t, Validate([]Config{{Type: TypeWebhook, URL: "http://localhost", Body: "{{.Message"}}))
+	assert.NotNil(t, Validate([]Config{{Type: TypeSlack, URL: "http://localhost", Routes: []Route{{Namespaces: []string{"["}}}}}))
+	assert.NotNil(t, Validate([]Config{{Type: TypeSlack, URL: "http://localhost", Retries: -1}}))
+
+	assert.Nil(t, Validate([]Config{
+		{Type: TypeSlack, URL: "http://localhost"},
+		{Type: TypeEmail, SMTPHost: "localhost", From: "elb-inject@example.com", To: []string{"ops@example.com"}},
+	}))
+}
+
+func TestSummarize(t *testing.T) {
+	var batch []Event
+	for i := 0; i < 25; i++ {
+		batch = append(batch, Event{
+			Type:           EventDeregisterFailed,
+			Namespace:      "team-a",
+			Pod:            fmt.Sprintf("web-%d", i),
+			TargetGroup:    "team-a-web",
+			TargetGroupARN: "arn:aws:elasticloadbalancing:us-west-2:123456789012:targetgroup/team-a-web/abc",
+			IP:             fmt.Sprintf("10.0.0.%d", i+10),
+			Reason:         "Throttling",
+			Message:        fmt.Sprintf("can not deregister web-%d", i),
+		})
+	}
+
+	assert.Equal(t, batch[0], summarize(batch[:1]))
+
+	summary := summarize(batch[:2])
+	assert.Equal(t, "team-a", summary.Namespace)
+	assert.Equal(t, "", summary.Pod)
+	assert.Contains(t, summary.Message, "2 x DeregisterFailed on team-a-web (Throttling)")
+	assert.Equal(t, "aws elbv2 deregister-targets --target-group-arn "+batch[0].TargetGroupARN+" --targets Id=10.0.0.10 Id=10.0.0.11", summary.Detail)
+
+	summary = summarize(batch)
+	assert.Equal(t, 20+2, len(strings.Split(summary.Message, "\n")))
+	assert.Contains(t, summary.Message, "... and 5 more")
+}
+
+func TestAggregator(t *testing.T) {
+	sent := make(chan Event, 10)
+	a := &aggregator{window: 50 * time.Millisecond, send: func(e Event) { sent <- e }, batches: make(map[string][]Event)}
+
+	a.add(Event{Type: EventRegisterFailed, TargetGroup: "web", Reason: "Throttling", Message: "a"})
+	a.add(Event{Type: EventRegisterFailed, TargetGroup: "web", Reason: "Throttling", Message: "b"})
+	a.add(Event{Type: EventRegisterFailed, TargetGroup: "api", Reason: "Throttling", Message: "c"})
+
+	received := map[string]Event{}
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-sent:
+			received[e.TargetGroup] = e
+		case <-time.After(time.Second):
+			t.Fatal("batch not flushed")
+		}
+	}
+	assert.Contains(t, received["web"].Message, "2 x RegisterFailed")
+	assert.Equal(t, "c", received["api"].Message)
+
+	a.add(Event{Type: EventPodStuck, TargetGroup: "web", Message: "d"})
+	a.close()
+	assert.Equal(t, "d", (<-sent).Message)
+	a.add(Event{Type: EventPodStuck, TargetGroup: "web", Message: "e"})
+	assert.Equal(t, "e", (<-sent).Message)
+}
+
+type stubNotifier struct {
+	failures int
+	sent     chan Event
+}
+
+func (n *stubNotifier) Notify(event Event) error {
+	if n.failures > 0 {
+		n.failures--
+		return errors.New("unavailable")
+	}
+	n.sent <- event
+	return nil
+}
+
+func TestChannelRetry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	notifier := &stubNotifier{failures: 2, sent: make(chan Event, 1)}
+	ch := newChannel(ctx, "stub", notifier, Config{})
+	ch.backoff = 10 * time.Millisecond
+	go ch.run()
+
+	ch.enqueue(delivery{event: Event{Type: EventPodStuck, Message: "stuck"}})
+	select {
+	case e := <-notifier.sent:
+		assert.Equal(t, "stuck", e.Message)
+	case <-time.After(time.Second):
+		t.Fatal("not retried")
+	}
+}
+
+func TestChannelClosed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := newChannel(ctx, "stub", &stubNotifier{sent: make(chan Event, 1)}, Config{})
+	cancel()
+
+	// nothing reads the queue anymore
+	ch.enqueue(delivery{event: Event{Type: EventPodStuck, Message: "stuck"}})
+	assert.Equal(t, 0, len(ch.queue))
+}
+
+func TestNotifiers(t *testing.T) {
+	bodies := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies <- r.Header.Get("X-Token") + string(body)
+		if strings.Contains(string(body), "fail") {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	event := Event{Type: EventDeregisterFailed, Namespace: "team-a", Pod: "web-0", Message: "can not deregister", Time: time.Now()}
+
+	slack, _ := New(Config{Type: TypeSlack, URL: server.URL})
+	assert.Nil(t, slack.Notify(event))
+	assert.Contains(t, <-bodies, "team-a/web-0")
+
+	teams, _ := New(Config{Type: TypeTeams, URL: server.URL})
+	assert.Nil(t, teams.Notify(event))
+	assert.Contains(t, <-bodies, "MessageCard")
+
+	webhook, _ := New(Config{Type: TypeWebhook, URL: server.URL})
+	assert.Nil(t, webhook.Notify(event))
+	decoded := Event{}
+	assert.Nil(t, json.Unmarshal([]byte(<-bodies), &decoded))
+	assert.Equal(t, "web-0", decoded.Pod)
+
+	webhook, _ = New(Config{Type: TypeWebhook, URL: server.URL, Headers: map[string]string{"X-Token": "secret"}, Body: `{"text": {{json .Message}}}`})
+	assert.Nil(t, webhook.Notify(event))
+	assert.Equal(t, `secret{"text": "can not deregister"}`, <-bodies)
+
+	event.Message = "fail"
+	assert.NotNil(t, webhook.Notify(event))
+}
+
+func TestEmailTimeout(t *testing.T) {
+	// accepts but never greets
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	email := &Email{Addr: listener.Addr().String(), From: "elb-inject@example.com", To: []string{"ops@example.com"}, Timeout: 100 * time.Millisecond}
+	start := time.Now()
+	assert.NotNil(t, email.Notify(Event{Type: EventDeregisterFailed, Message: "can not deregister", Time: time.Now()}))
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestSlackBlocks(t *testing.T) {
+	event := Event{
+		Type:           EventDeregisterFailed,
+		Namespace:      "team-a",
+		Pod:            "web-0",
+		TargetGroup:    "team-a-web",
+		TargetGroupARN: "arn:aws:elasticloadbalancing:us-west-2:123456789012:targetgroup/team-a-web/abc",
+		IP:             "10.0.0.10",
+		Reason:         "Throttling",
+		Message:        "can not deregister",
+	}
+
+	data, _ := json.Marshal((&Slack{}).blocks(event))
+	assert.Contains(t, string(data), "https://us-west-2.console.aws.amazon.com/ec2/home?region=us-west-2#TargetGroup:targetGroupArn=")
+	assert.Contains(t, string(data), "Throttling")
+	assert.NotContains(t, string(data), ActionRetryDeregistration)
+
+	button := (&Slack{Interactive: true}).retryButton(event)
+	value := RetryValue{}
+	assert.Nil(t, json.Unmarshal([]byte(button["value"].(string)), &value))
+	assert.Equal(t, RetryValue{TargetGroup: "team-a-web", IPs: []string{"10.0.0.10"}}, value)
+
+	event.Type = EventPodStuck
+	assert.Nil(t, (&Slack{Interactive: true}).retryButton(event))
+
+	// a long pod name still fits the header
+	event.Pod = strings.Repeat("web-ü", 40)
+	header := (&Slack{}).blocks(event)[0]["text"].(slackText).Text
+	assert.Equal(t, slackMaxHeader, utf8.RuneCountInString(header))
+	assert.True(t, utf8.ValidString(header))
+	assert.True(t, utf8.ValidString(mrkdwn(strings.Repeat("ü", slackMaxText)).Text))
+	assert.Equal(t, slackMaxText, utf8.RuneCountInString(mrkdwn(strings.Repeat("ü", slackMaxText+1)).Text))
+}
+
+func TestSlackAction(t *testing.T) {
+	secret := []byte("8f742231b10e8888abcd99yyyzzz85a5")
+	payload := `{"type":"block_actions","user":{"id":"U1","username":"oncall"},"response_url":"https://hooks.slack.com/actions/x",` +
+		`"actions":[{"action_id":"retry_deregistration","value":"{\"targetGroup\":\"web\",\"ips\":[\"10.0.0.10\"]}"}]}`
+	body := []byte(url.Values{"payload": {payload}}.Encode())
+
+	now := time.Now()
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte("v0:" + timestamp + ":" + string(body)))
+	header := http.Header{}
+	header.Set("X-Slack-Request-Timestamp", timestamp)
+	header.Set("X-Slack-Signature", "v0="+hex.EncodeToString(mac.Sum(nil)))
+
+	assert.Nil(t, VerifySlackRequest(secret, header, body, now))
+	assert.NotNil(t, VerifySlackRequest([]byte("other"), header, body, now))
+	assert.NotNil(t, VerifySlackRequest(secret, header, append(body, 'x'), now))
+	assert.NotNil(t, VerifySlackRequest(secret, header, body, now.Add(10*time.Minute)))
+
+	action, err := ParseSlackAction(body)
+	assert.Nil(t, err)
+	assert.Equal(t, ActionRetryDeregistration, action.ActionID)
+	assert.Equal(t, "oncall", action.User)
+	assert.Equal(t, "https://hooks.slack.com/actions/x", action.ResponseURL)
+
+	_, err = ParseSlackAction([]byte(url.Values{"payload": {`{"type":"view_submission"}`}}.Encode()))
+	assert.NotNil(t, err)
+}
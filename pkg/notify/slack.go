@@ -0,0 +1,155 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// action_id of the retry button, see ParseSlackAction
+	ActionRetryDeregistration = "retry_deregistration"
+
+	// slack limits of a button value, a text field and a header, in characters
+	slackMaxValue  = 2000
+	slackMaxText   = 3000
+	slackMaxHeader = 150
+)
+
+// Slack posts a Block Kit message to an incoming webhook
+type Slack struct {
+	URL string
+	// add a retry button to failed deregistrations, it calls back the
+	// controller, see the Interactivity Request URL of the slack app
+	Interactive bool
+}
+
+func newSlack(config Config) (*Slack, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("slack: url is required")
+	}
+	return &Slack{URL: config.URL, Interactive: config.Interactive}, nil
+}
+
+func (s *Slack) Notify(event Event) error {
+	body, err := json.Marshal(map[string]interface{}{
+		// shows in push notifications
+		"text":   event.Title(),
+		"blocks": s.blocks(event),
+	})
+	if err != nil {
+		return err
+	}
+	return post(http.MethodPost, s.URL, body, nil)
+}
+
+// RetryValue is the value of the retry button
+type RetryValue struct {
+	TargetGroup string   `json:"targetGroup"`
+	IPs         []string `json:"ips"`
+}
+
+type slackText struct {
+	Type string `json:"type"`
+	Text string `json:"text"`
+}
+
+func mrkdwn(text string) slackText {
+	return slackText{Type: "mrkdwn", Text: truncate(text, slackMaxText)}
+}
+
+// truncate cuts text to max characters, slack rejects the whole message
+// when a field is longer
+func truncate(text string, max int) string {
+	if utf8.RuneCountInString(text) <= max {
+		return text
+	}
+	return string([]rune(text)[:max-3]) + "..."
+}
+
+func (s *Slack) blocks(event Event) []map[string]interface{} {
+	blocks := []map[string]interface{}{
+		{"type": "header", "text": slackText{Type: "plain_text", Text: truncate(event.Title(), slackMaxHeader)}},
+	}
+
+	var fields []slackText
+	for _, field := range [][2]string{
+		{"Namespace", event.Namespace},
+		{"Pod", event.Pod},
+		{"IP", event.IP},
+		{"Target group", event.TargetGroup},
+		{"Error", event.Reason},
+		{"Time", event.Time.Format("2006-01-02 15:04:05 MST")},
+	} {
+		if field[1] != "" {
+			fields = append(fields, mrkdwn(fmt.Sprintf("*%s*\n%s", field[0], field[1])))
+		}
+	}
+	blocks = append(blocks,
+		map[string]interface{}{"type": "section", "fields": fields},
+		map[string]interface{}{"type": "section", "text": mrkdwn(event.Message)},
+	)
+
+	if event.Detail != "" {
+		blocks = append(blocks, map[string]interface{}{"type": "section", "text": mrkdwn("```" + event.Detail + "```")})
+	}
+
+	if event.TargetGroupARN != "" {
+		blocks = append(blocks, map[string]interface{}{
+			"type": "context",
+			"elements": []slackText{
+				mrkdwn(fmt.Sprintf("<%s|%s>", consoleURL(event.TargetGroupARN), event.TargetGroupARN)),
+			},
+		})
+	}
+
+	if button := s.retryButton(event); button != nil {
+		blocks = append(blocks, map[string]interface{}{"type": "actions", "elements": []interface{}{button}})
+	}
+	return blocks
+}
+
+// retryButton deregisters the targets of a failed deregistration again
+func (s *Slack) retryButton(event Event) map[string]interface{} {
+	if !s.Interactive || event.Type != EventDeregisterFailed {
+		return nil
+	}
+	ips := event.IPs
+	if len(ips) == 0 && event.IP != "" {
+		ips = []string{event.IP}
+	}
+	if len(ips) == 0 {
+		return nil
+	}
+
+	value, err := json.Marshal(RetryValue{TargetGroup: event.TargetGroup, IPs: ips})
+	if err != nil || len(value) > slackMaxValue {
+		return nil
+	}
+	return map[string]interface{}{
+		"type":      "button",
+		"action_id": ActionRetryDeregistration,
+		"text":      slackText{Type: "plain_text", Text: "Retry deregistration"},
+		"style":     "danger",
+		"value":     string(value),
+		"confirm": map[string]interface{}{
+			"title":   slackText{Type: "plain_text", Text: "Retry deregistration?"},
+			"text":    mrkdwn(fmt.Sprintf("Deregister %s from %s", strings.Join(ips, ", "), event.TargetGroup)),
+			"confirm": slackText{Type: "plain_text", Text: "Deregister"},
+			"deny":    slackText{Type: "plain_text", Text: "Cancel"},
+		},
+	}
+}
+
+// consoleURL links to the target group in the AWS console,
+// arn:aws:elasticloadbalancing:<region>:<account>:targetgroup/<name>/<id>
+func consoleURL(arn string) string {
+	parts := strings.Split(arn, ":")
+	if len(parts) < 6 {
+		return "https://console.aws.amazon.com/ec2/home#TargetGroups:"
+	}
+	region := parts[3]
+	return fmt.Sprintf("https://%s.console.aws.amazon.com/ec2/home?region=%s#TargetGroup:targetGroupArn=%s", region, region, arn)
+}
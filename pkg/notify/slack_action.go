@@ -0,0 +1,102 @@
+package notify
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// requests older than this are replays
+const slackMaxRequestAge = 5 * time.Minute
+
+// SlackAction is a button clicked in a slack message
+type SlackAction struct {
+	ActionID string
+	Value    string
+	// who clicked
+	User        string
+	ResponseURL string
+}
+
+// VerifySlackRequest checks the signature slack computes with the signing
+// secret of the app, https://api.slack.com/authentication/verifying-requests-from-slack
+func VerifySlackRequest(secret []byte, header http.Header, body []byte, now time.Time) error {
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+	if age := now.Sub(time.Unix(ts, 0)); age > slackMaxRequestAge || age < -slackMaxRequestAge {
+		return fmt.Errorf("timestamp %s is too far from now", timestamp)
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	_, _ = mac.Write([]byte("v0:" + timestamp + ":"))
+	_, _ = mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature"))) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+// ParseSlackAction reads the first action of a block_actions payload, the
+// form encoded body slack posts to the Interactivity Request URL
+func ParseSlackAction(body []byte) (*SlackAction, error) {
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, err
+	}
+
+	var payload struct {
+		Type string `json:"type"`
+		User struct {
+			ID       string `json:"id"`
+			Username string `json:"username"`
+		} `json:"user"`
+		ResponseURL string `json:"response_url"`
+		Actions     []struct {
+			ActionID string `json:"action_id"`
+			Value    string `json:"value"`
+		} `json:"actions"`
+	}
+	if err := json.Unmarshal([]byte(form.Get("payload")), &payload); err != nil {
+		return nil, fmt.Errorf("invalid payload: %v", err)
+	}
+	if payload.Type != "block_actions" || len(payload.Actions) == 0 {
+		return nil, fmt.Errorf("unsupported interaction %q", payload.Type)
+	}
+
+	user := payload.User.Username
+	if user == "" {
+		user = payload.User.ID
+	}
+	return &SlackAction{
+		ActionID:    payload.Actions[0].ActionID,
+		Value:       payload.Actions[0].Value,
+		User:        user,
+		ResponseURL: payload.ResponseURL,
+	}, nil
+}
+
+// Reply posts text to the channel of the clicked message
+func (a *SlackAction) Reply(text string) error {
+	if a.ResponseURL == "" {
+		return nil
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"response_type":    "in_channel",
+		"replace_original": false,
+		"text":             text,
+	})
+	if err != nil {
+		return err
+	}
+	return post(http.MethodPost, a.ResponseURL, body, nil)
+}
@@ -0,0 +1,39 @@
+package notify
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Teams posts a MessageCard to a Microsoft Teams incoming webhook
+type Teams struct {
+	URL string
+}
+
+func newTeams(config Config) (*Teams, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("teams: url is required")
+	}
+	return &Teams{URL: config.URL}, nil
+}
+
+func (t *Teams) Notify(event Event) error {
+	text := event.Message
+	if event.Detail != "" {
+		text += fmt.Sprintf("\n\n`%s`", event.Detail)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"@type":      "MessageCard",
+		"@context":   "https://schema.org/extensions",
+		"summary":    event.Title(),
+		"title":      event.Title(),
+		"text":       text,
+		"themeColor": "D70000",
+	})
+	if err != nil {
+		return err
+	}
+	return post(http.MethodPost, t.URL, body, nil)
+}
@@ -0,0 +1,63 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"text/template"
+)
+
+// Webhook posts the event to any http endpoint, as json or through a template
+type Webhook struct {
+	URL     string
+	Method  string
+	Headers map[string]string
+	// nil sends the event as json
+	body *template.Template
+}
+
+var templateFuncs = template.FuncMap{
+	// json quotes a value, e.g. "text": {{json .Message}}
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+func newWebhook(config Config) (*Webhook, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("webhook: url is required")
+	}
+
+	w := &Webhook{URL: config.URL, Method: config.Method, Headers: config.Headers}
+	if w.Method == "" {
+		w.Method = http.MethodPost
+	}
+	if config.Body != "" {
+		body, err := template.New("body").Funcs(templateFuncs).Option("missingkey=error").Parse(config.Body)
+		if err != nil {
+			return nil, fmt.Errorf("webhook: invalid body template: %v", err)
+		}
+		w.body = body
+	}
+	return w, nil
+}
+
+func (w *Webhook) Notify(event Event) error {
+	var body []byte
+	if w.body == nil {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		body = data
+	} else {
+		buf := &bytes.Buffer{}
+		if err := w.body.Execute(buf, event); err != nil {
+			return err
+		}
+		body = buf.Bytes()
+	}
+	return post(w.Method, w.URL, body, w.Headers)
+}
@@ -0,0 +1,215 @@
+package policy
+
+import (
+	"fmt"
+	"path"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+	"sigs.k8s.io/yaml"
+)
+
+// ConfigMapKey holds the policy in the ConfigMap
+const ConfigMapKey = "policy.yaml"
+
+// Rule allows pods of Namespaces or ServiceAccounts to use target groups
+// matching TargetGroups, TargetGroupARNs or Tags. Patterns use path.Match syntax.
+type Rule struct {
+	Namespaces []string `json:"namespaces,omitempty"`
+	// name, or namespace/name
+	ServiceAccounts []string          `json:"serviceAccounts,omitempty"`
+	TargetGroups    []string          `json:"targetGroups,omitempty"`
+	TargetGroupARNs []string          `json:"targetGroupARNs,omitempty"`
+	Tags            map[string]string `json:"tags,omitempty"`
+}
+
+type Policy struct {
+	// allow pods no rule applies to
+	DefaultAllow bool   `json:"defaultAllow,omitempty"`
+	Rules        []Rule `json:"rules"`
+}
+
+// TargetGroup is what a rule is matched against
+type TargetGroup struct {
+	Name string
+	ARN  string
+	Tags map[string]string
+}
+
+// Parse reads a policy in yaml or json
+func Parse(data []byte) (*Policy, error) {
+	policy := &Policy{}
+	if err := yaml.Unmarshal(data, policy); err != nil {
+		return nil, err
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+// Validate checks every pattern of the rules
+func (p *Policy) Validate() error {
+	for i, rule := range p.Rules {
+		patterns := append(append(append([]string{}, rule.Namespaces...), rule.ServiceAccounts...), rule.TargetGroups...)
+		patterns = append(patterns, rule.TargetGroupARNs...)
+		for _, v := range rule.Tags {
+			patterns = append(patterns, v)
+		}
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("rule %d: invalid pattern %q: %v", i, pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Allowed tells whether po may use targetGroup, reason explains a denial
+func (p *Policy) Allowed(po *corev1.Pod, targetGroup TargetGroup) (bool, string) {
+	serviceAccount := po.Spec.ServiceAccountName
+	if serviceAccount == "" {
+		serviceAccount = "default"
+	}
+
+	applied := false
+	for _, rule := range p.Rules {
+		if !matchAny(rule.Namespaces, po.Namespace) &&
+			!matchAny(rule.ServiceAccounts, serviceAccount) &&
+			!matchAny(rule.ServiceAccounts, po.Namespace+"/"+serviceAccount) {
+			continue
+		}
+		applied = true
+
+		if matchAny(rule.TargetGroups, targetGroup.Name) || matchAny(rule.TargetGroupARNs, targetGroup.ARN) || matchTags(rule.Tags, targetGroup.Tags) {
+			return true, ""
+		}
+	}
+
+	if !applied {
+		if p.DefaultAllow {
+			return true, ""
+		}
+		return false, fmt.Sprintf("no policy rule for namespace %s, service account %s", po.Namespace, serviceAccount)
+	}
+	return false, fmt.Sprintf("target group %s is not allowed for namespace %s, service account %s", targetGroup.Name, po.Namespace, serviceAccount)
+}
+
+func matchAny(patterns []string, s string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, s); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func matchTags(patterns map[string]string, tags map[string]string) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+	for key, pattern := range patterns {
+		value, ok := tags[key]
+		if !ok {
+			return false
+		}
+		if matched, _ := path.Match(pattern, value); !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// Store follows the policy ConfigMap. Everything is denied until a valid
+// policy is loaded, the last valid one is kept when the ConfigMap becomes
+// invalid or is deleted.
+type Store struct {
+	namespace string
+	name      string
+	informer  cache.SharedIndexInformer
+
+	mu     sync.RWMutex
+	policy *Policy
+}
+
+func NewStore(client kubernetes.Interface, namespace, name string) *Store {
+	factory := informers.NewSharedInformerFactoryWithOptions(client, 0,
+		informers.WithNamespace(namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+		}),
+	)
+
+	s := &Store{
+		namespace: namespace,
+		name:      name,
+		informer:  factory.Core().V1().ConfigMaps().Informer(),
+	}
+
+	s.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    s.update,
+		UpdateFunc: func(_, new interface{}) { s.update(new) },
+		DeleteFunc: func(_ interface{}) {
+			klog.Warningf("Policy: %s/%s was deleted, keeping the previous policy", namespace, name)
+		},
+	})
+	return s
+}
+
+// Run follows the ConfigMap until stopCh is closed
+func (s *Store) Run(stopCh <-chan struct{}) {
+	s.informer.Run(stopCh)
+}
+
+func (s *Store) HasSynced() bool {
+	return s.informer.HasSynced()
+}
+
+func (s *Store) update(obj interface{}) {
+	cm, ok := obj.(*corev1.ConfigMap)
+	if !ok {
+		return
+	}
+
+	policy, err := Parse([]byte(cm.Data[ConfigMapKey]))
+	if err != nil {
+		// keep the previous one rather than opening everything
+		klog.Errorf("Policy: can not parse %s/%s, keeping the previous policy: %v", s.namespace, s.name, err)
+		return
+	}
+	s.set(policy)
+}
+
+func (s *Store) set(policy *Policy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	klog.Infof("Policy: loaded %d rules from %s/%s", len(policy.Rules), s.namespace, s.name)
+	s.policy = policy
+}
+
+// Loaded tells whether a valid policy was loaded
+func (s *Store) Loaded() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.policy != nil
+}
+
+// Allowed tells whether po may use targetGroup, reason explains a denial.
+// Nothing is allowed before a valid policy is loaded.
+func (s *Store) Allowed(po *corev1.Pod, targetGroup TargetGroup) (bool, string) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.policy == nil {
+		return false, fmt.Sprintf("no valid policy loaded from %s/%s", s.namespace, s.name)
+	}
+	return s.policy.Allowed(po, targetGroup)
+}
@@ -0,0 +1,86 @@
+package policy
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const testPolicy = `
+rules:
+- namespaces: ["team-a"]
+  targetGroups: ["team-a-*"]
+- serviceAccounts: ["team-b/deployer"]
+  targetGroupARNs: ["arn:aws:elasticloadbalancing:*:targetgroup/team-b-*/*"]
+- namespaces: ["team-c"]
+  tags:
+    team: c
+`
+
+func TestPolicy(t *testing.T) {
+	policy, err := Parse([]byte(testPolicy))
+	assert.Nil(t, err)
+
+	pod := func(namespace, serviceAccount string) *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: "foo"},
+			Spec:       corev1.PodSpec{ServiceAccountName: serviceAccount},
+		}
+	}
+
+	allowed, _ := policy.Allowed(pod("team-a", ""), TargetGroup{Name: "team-a-web"})
+	assert.True(t, allowed)
+
+	allowed, reason := policy.Allowed(pod("team-a", ""), TargetGroup{Name: "team-b-web"})
+	assert.False(t, allowed)
+	assert.Contains(t, reason, "team-b-web")
+
+	allowed, _ = policy.Allowed(pod("team-b", "deployer"), TargetGroup{Name: "team-b-web", ARN: "arn:aws:elasticloadbalancing:us-west-2:123456789012:targetgroup/team-b-web/1234"})
+	assert.True(t, allowed)
+
+	allowed, _ = policy.Allowed(pod("team-b", "default"), TargetGroup{Name: "team-b-web", ARN: "arn:aws:elasticloadbalancing:us-west-2:123456789012:targetgroup/team-b-web/1234"})
+	assert.False(t, allowed)
+
+	allowed, _ = policy.Allowed(pod("team-c", ""), TargetGroup{Name: "anything", Tags: map[string]string{"team": "c"}})
+	assert.True(t, allowed)
+
+	allowed, _ = policy.Allowed(pod("team-c", ""), TargetGroup{Name: "anything", Tags: map[string]string{"team": "a"}})
+	assert.False(t, allowed)
+
+	allowed, _ = policy.Allowed(pod("team-d", ""), TargetGroup{Name: "team-a-web"})
+	assert.False(t, allowed)
+
+	policy.DefaultAllow = true
+	allowed, _ = policy.Allowed(pod("team-d", ""), TargetGroup{Name: "team-a-web"})
+	assert.True(t, allowed)
+
+	_, err = Parse([]byte(`rules: [{namespaces: ["[a-"]}]`))
+	assert.NotNil(t, err)
+}
+
+func TestStore(t *testing.T) {
+	s := &Store{namespace: "default", name: "elb-inject-policy"}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "foo"}}
+
+	// nothing loaded yet
+	allowed, reason := s.Allowed(pod, TargetGroup{Name: "team-a-web"})
+	assert.False(t, allowed)
+	assert.Contains(t, reason, "no valid policy")
+
+	// invalid first load
+	s.update(&corev1.ConfigMap{Data: map[string]string{ConfigMapKey: "rules: ["}})
+	assert.False(t, s.Loaded())
+
+	s.update(&corev1.ConfigMap{Data: map[string]string{ConfigMapKey: testPolicy}})
+	allowed, _ = s.Allowed(pod, TargetGroup{Name: "team-a-web"})
+	assert.True(t, allowed)
+
+	// a broken update keeps the last valid policy
+	s.update(&corev1.ConfigMap{Data: map[string]string{ConfigMapKey: "defaultAllow: [true"}})
+	allowed, _ = s.Allowed(pod, TargetGroup{Name: "team-a-web"})
+	assert.True(t, allowed)
+	allowed, _ = s.Allowed(pod, TargetGroup{Name: "team-b-web"})
+	assert.False(t, allowed)
+}
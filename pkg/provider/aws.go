@@ -1,6 +1,8 @@
 package provider
 
 import (
+	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -8,9 +10,11 @@ import (
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/elbv2"
 	"github.com/linki/instrumented_http"
 	"github.com/patrickmn/go-cache"
+	"github.com/zduymz/elb-inject/pkg/dryrun"
 	"github.com/zduymz/elb-inject/pkg/utils"
 	"k8s.io/klog"
 )
@@ -19,14 +23,38 @@ type TargetGroupAPI interface {
 	DescribeTargetGroups(input *elbv2.DescribeTargetGroupsInput) (*elbv2.DescribeTargetGroupsOutput, error)
 	RegisterTargets(input *elbv2.RegisterTargetsInput) (*elbv2.RegisterTargetsOutput, error)
 	DeregisterTargets(input *elbv2.DeregisterTargetsInput) (*elbv2.DeregisterTargetsOutput, error)
+	DescribeTargetGroupAttributes(input *elbv2.DescribeTargetGroupAttributesInput) (*elbv2.DescribeTargetGroupAttributesOutput, error)
+	DescribeTargetHealth(input *elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error)
+	DescribeTags(input *elbv2.DescribeTagsInput) (*elbv2.DescribeTagsOutput, error)
+	AddTags(input *elbv2.AddTagsInput) (*elbv2.AddTagsOutput, error)
+}
+
+type SubnetAPI interface {
+	DescribeSubnets(input *ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error)
 }
 
 const DefaultCacheTTL = 5*time.Minute
 
+// minimum time between two forced refreshes of the target groups
+const minRefreshInterval = 10 * time.Second
+
 type AWSProvider struct {
 	client    TargetGroupAPI
-	dryRun    bool
+	ec2Client SubnetAPI
+	dryRun    *dryrun.Recorder
 	cachePool *cache.Cache
+	// every target group by name
+	targetGroups *targetGroupCache
+
+	// cluster vpc, vpc check is skipped when empty
+	vpcID string
+	// register ip outside of the vpc subnets with AvailabilityZone all
+	allowOutsideVPC bool
+
+	// ownership check is skipped when clusterName is empty
+	clusterName       string
+	claimTargetGroups bool
+	allowForeign      bool
 }
 
 // AWSConfig contains configuration to create a new AWS provider.
@@ -34,7 +62,19 @@ type AWSConfig struct {
 	Region     string
 	AssumeRole string
 	APIRetries int
-	DryRun     bool
+	// timeout of a single aws api request, no timeout when 0
+	RequestTimeout time.Duration
+	// records mutations instead of making them, nil makes them
+	DryRun *dryrun.Recorder
+	// discovered from ec2 metadata when empty
+	VPCId           string
+	AllowOutsideVPC bool
+
+	ClusterName string
+	// tag unclaimed target groups with ClusterName
+	ClaimTargetGroups bool
+	// use target groups claimed by another cluster
+	AllowForeignTargetGroups bool
 
 	AWSCredsFile string
 }
@@ -51,7 +91,7 @@ func NewAWSProvider(awsConfig AWSConfig) (*AWSProvider, error) {
 	}
 
 	config.WithHTTPClient(
-		instrumented_http.NewClient(config.HTTPClient, &instrumented_http.Callbacks{
+		instrumented_http.NewClient(&http.Client{Timeout: awsConfig.RequestTimeout}, &instrumented_http.Callbacks{
 			PathProcessor: func(path string) string {
 				parts := strings.Split(path, "/")
 				return parts[len(parts)-1]
@@ -73,24 +113,49 @@ func NewAWSProvider(awsConfig AWSConfig) (*AWSProvider, error) {
 		awsSession.Config.WithCredentials(stscreds.NewCredentials(awsSession, awsConfig.AssumeRole))
 	}
 
-	provider := &AWSProvider{
-		client:    elbv2.New(awsSession),
-		dryRun:    awsConfig.DryRun,
-		cachePool: cache.New(DefaultCacheTTL, 10*time.Minute),
+	vpcID := awsConfig.VPCId
+	if vpcID == "" {
+		if vpcID, err = discoverVPC(awsSession); err != nil {
+			klog.Warningf("Can not discover cluster vpc, vpc check is disabled. Reason: %v", err)
+		} else {
+			klog.Infof("Discovered cluster vpc: %s", vpcID)
+		}
 	}
 
-	return provider, nil
+	awsConfig.VPCId = vpcID
+	return NewAWSProviderWithClients(elbv2.New(awsSession), ec2.New(awsSession), awsConfig), nil
 }
 
-// Return targetGroup in map[Name: ARN]
-// I only care the targetGroup with TargetType is IP
-func (p *AWSProvider) getTargetGroups() (map[string]*string, error) {
-	foo, found := p.cachePool.Get("tg")
-	if found {
-		klog.V(4).Info("Target Group Cache hit")
-		return foo.(map[string]*string), nil
+// NewAWSProviderWithClients creates a provider calling client and ec2Client,
+// the VPC is not discovered
+func NewAWSProviderWithClients(client TargetGroupAPI, ec2Client SubnetAPI, awsConfig AWSConfig) *AWSProvider {
+	provider := &AWSProvider{
+		client:          client,
+		ec2Client:       ec2Client,
+		dryRun:          awsConfig.DryRun,
+		cachePool:       cache.New(DefaultCacheTTL, 10*time.Minute),
+		vpcID:           awsConfig.VPCId,
+		allowOutsideVPC: awsConfig.AllowOutsideVPC,
+
+		clusterName:       awsConfig.ClusterName,
+		claimTargetGroups: awsConfig.ClaimTargetGroups,
+		allowForeign:      awsConfig.AllowForeignTargetGroups,
 	}
-	targetGroups := make(map[string]*string)
+	provider.initTargetGroupCache()
+
+	return provider
+}
+
+func (p *AWSProvider) initTargetGroupCache() {
+	p.targetGroups = newTargetGroupCache(p.fetchTargetGroups, func() {
+		// tags are described for the cached target groups
+		p.cachePool.Delete("tags")
+	})
+}
+
+// fetchTargetGroups returns all targetGroups in map[Name: TargetGroup], whatever TargetType is
+func (p *AWSProvider) fetchTargetGroups() (map[string]*elbv2.TargetGroup, error) {
+	targetGroups := make(map[string]*elbv2.TargetGroup)
 	describeTargetGroupsInput := &elbv2.DescribeTargetGroupsInput{
 		PageSize: aws.Int64(400),
 	}
@@ -99,83 +164,223 @@ func (p *AWSProvider) getTargetGroups() (map[string]*string, error) {
 		describeTargetGroupsOutput, err := p.client.DescribeTargetGroups(describeTargetGroupsInput)
 		if err != nil {
 			klog.Errorf("Can not describe TargetGroup: %s", err.Error())
-			return nil, err
+			return nil, wrapError("DescribeTargetGroups", "", "", err)
 		}
 
 		describeTargetGroupsInput.Marker = describeTargetGroupsOutput.NextMarker
 
 		for _, targetGroup := range describeTargetGroupsOutput.TargetGroups {
-			// only support target type IP
-			if *targetGroup.TargetType == elbv2.TargetTypeEnumIp {
-				targetGroups[*targetGroup.TargetGroupName] = targetGroup.TargetGroupArn
-			}
+			targetGroups[*targetGroup.TargetGroupName] = targetGroup
 		}
 
 		if describeTargetGroupsOutput.NextMarker == nil {
 			break
 		}
 	}
+	klog.V(4).Infof("Described %d target groups", len(targetGroups))
+	return targetGroups, nil
+}
+
+// describeTargetGroups returns the cached targetGroups in map[Name: TargetGroup]
+func (p *AWSProvider) describeTargetGroups() (map[string]*elbv2.TargetGroup, error) {
+	return p.targetGroups.get()
+}
+
+// lookupTargetGroup returns targetGroupName whatever its TargetType is, nil
+// when it doesn't exist
+func (p *AWSProvider) lookupTargetGroup(targetGroupName string) (*elbv2.TargetGroup, error) {
+	return p.targetGroups.lookup(targetGroupName)
+}
+
+// RefreshTargetGroups describes the target groups again, e.g. after aws
+// answered not found for a cached arn. It does nothing when they were
+// described within minRefreshInterval.
+func (p *AWSProvider) RefreshTargetGroups() {
+	if p.targetGroups.age() < minRefreshInterval {
+		return
+	}
+	if err := p.targetGroups.refresh(refreshMiss); err != nil {
+		klog.Errorf("Can not refresh target groups: %v", err)
+	}
+}
+
+// RunTargetGroupRefresh refreshes the target groups every interval until stopCh is closed
+func (p *AWSProvider) RunTargetGroupRefresh(interval time.Duration, stopCh <-chan struct{}) {
+	p.targetGroups.run(interval, stopCh)
+}
+
+// Return targetGroup in map[Name: ARN]
+// I only care the targetGroup with TargetType is IP
+func (p *AWSProvider) getTargetGroups() (map[string]*string, error) {
+	all, err := p.describeTargetGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	targetGroups := make(map[string]*string)
+	for name, targetGroup := range all {
+		// only support target type IP
+		if aws.StringValue(targetGroup.TargetType) == elbv2.TargetTypeEnumIp {
+			targetGroups[name] = targetGroup.TargetGroupArn
+		}
+	}
 	klog.V(4).Infof("TargetGroups available: %v", targetGroups)
-	p.cachePool.Set("tg", targetGroups, DefaultCacheTTL)
 	return targetGroups, nil
 }
 
+// LookupTargetGroup returns ip type targetGroupName
+func (p *AWSProvider) LookupTargetGroup(targetGroupName string) (*elbv2.TargetGroup, error) {
+	targetGroup, err := p.lookupTargetGroup(targetGroupName)
+	if err != nil {
+		return nil, err
+	}
+
+	if targetGroup == nil || aws.StringValue(targetGroup.TargetType) != elbv2.TargetTypeEnumIp {
+		return nil, utils.TargetGroupNotFound{Name: targetGroupName}
+	}
+	return targetGroup, nil
+}
+
+// ValidateTargetGroup makes sure a pod ip can be registered to targetGroupName.
+// vpc check is skipped when the cluster vpc is unknown.
+func (p *AWSProvider) ValidateTargetGroup(targetGroupName string) error {
+	targetGroup, err := p.lookupTargetGroup(targetGroupName)
+	if err != nil {
+		return err
+	}
+
+	if targetGroup == nil {
+		return utils.TargetGroupNotFound{Name: targetGroupName}
+	}
+
+	if targetType := aws.StringValue(targetGroup.TargetType); targetType != elbv2.TargetTypeEnumIp {
+		return utils.TargetGroupNotIPType{Name: targetGroupName, TargetType: targetType}
+	}
+
+	if p.vpcID != "" && aws.StringValue(targetGroup.VpcId) != p.vpcID {
+		return utils.TargetGroupVPCMismatch{Name: targetGroupName, VpcId: aws.StringValue(targetGroup.VpcId), ExpectedVpcId: p.vpcID}
+	}
+
+	return p.checkOwnership(targetGroup, false)
+}
+
+// GetIPAddressType returns ipv4 or ipv6, the address family targetGroupName accepts
+func (p *AWSProvider) GetIPAddressType(targetGroupName string) (string, error) {
+	targetGroup, err := p.LookupTargetGroup(targetGroupName)
+	if err != nil {
+		return "", err
+	}
+
+	// target groups created before dual-stack support don't have it
+	if targetGroup.IpAddressType == nil {
+		return elbv2.TargetGroupIpAddressTypeEnumIpv4, nil
+	}
+	return *targetGroup.IpAddressType, nil
+}
+
+// GetDeregistrationDelay returns deregistration_delay.timeout_seconds of targetGroupName
+func (p *AWSProvider) GetDeregistrationDelay(targetGroupName string) (int64, error) {
+	targetGroup, err := p.LookupTargetGroup(targetGroupName)
+	if err != nil {
+		return 0, err
+	}
+
+	// by arn, a recreated target group has its own
+	cacheKey := "delay/" + aws.StringValue(targetGroup.TargetGroupArn)
+	if foo, found := p.cachePool.Get(cacheKey); found {
+		return foo.(int64), nil
+	}
+
+	output, err := p.client.DescribeTargetGroupAttributes(&elbv2.DescribeTargetGroupAttributesInput{
+		TargetGroupArn: targetGroup.TargetGroupArn,
+	})
+	if err != nil {
+		return 0, wrapError("DescribeTargetGroupAttributes", targetGroupName, aws.StringValue(targetGroup.TargetGroupArn), err)
+	}
+
+	// aws default
+	var delay int64 = 300
+	for _, attribute := range output.Attributes {
+		if aws.StringValue(attribute.Key) != "deregistration_delay.timeout_seconds" {
+			continue
+		}
+		if delay, err = strconv.ParseInt(aws.StringValue(attribute.Value), 10, 64); err != nil {
+			return 0, err
+		}
+	}
+
+	p.cachePool.Set(cacheKey, delay, DefaultCacheTTL)
+	return delay, nil
+}
+
 func (p *AWSProvider) RegisterIPToTargetGroup(targetGroupName *string, IPAddress *string) error {
-	klog.V(4).Info("Getting list of current TargetGroups")
-	targetGroups, err := p.getTargetGroups()
+	targetGroup, err := p.lookupTargetGroup(*targetGroupName)
 	if err != nil {
 		return err
 	}
 
-	if exist := targetGroups[*targetGroupName]; exist == nil {
-		klog.Errorf("TargetGroupName: %s is not found", *targetGroupName)
-		return nil
+	if targetGroup == nil {
+		return utils.TargetGroupNotFound{Name: *targetGroupName}
+	}
+
+	if targetType := aws.StringValue(targetGroup.TargetType); targetType != elbv2.TargetTypeEnumIp {
+		return utils.TargetGroupNotIPType{Name: *targetGroupName, TargetType: targetType}
+	}
+
+	target, err := p.targetDescription(targetGroup, *IPAddress)
+	if err != nil {
+		return err
 	}
 
-	target := &elbv2.TargetDescription{
-		Id: IPAddress,
+	if err := p.checkOwnership(targetGroup, true); err != nil {
+		return err
 	}
 
 	params := &elbv2.RegisterTargetsInput{
-		TargetGroupArn: targetGroups[*targetGroupName],
+		TargetGroupArn: targetGroup.TargetGroupArn,
 		Targets:        []*elbv2.TargetDescription{target},
 	}
 
+	if p.dryRun != nil {
+		p.dryRun.Record(dryrun.ActionRegister, *targetGroupName, *IPAddress, aws.StringValue(target.AvailabilityZone))
+		return nil
+	}
+
 	if _, err := p.client.RegisterTargets(params); err != nil {
 		klog.Errorf("Can not register %s to targetGroup %s. Reason: %s", *IPAddress, *targetGroupName, err.Error())
-		return err
+		return wrapError("RegisterTargets", *targetGroupName, aws.StringValue(targetGroup.TargetGroupArn), err)
 	}
 
 	return nil
 }
 
 func (p *AWSProvider) DeregisterIPFromTargetGroup(targetGroupName *string, IPAddress *string) error {
-	targetGroups, err := p.getTargetGroups()
+	targetGroup, err := p.lookupTargetGroup(*targetGroupName)
 	if err != nil {
 		return err
 	}
 
-	if exist := targetGroups[*targetGroupName]; exist == nil {
+	if targetGroup == nil || aws.StringValue(targetGroup.TargetType) != elbv2.TargetTypeEnumIp {
 		klog.Errorf("TargetGroupName: %s is not found", *targetGroupName)
 		return nil
 	}
 
-	target := &elbv2.TargetDescription{
-		Id: IPAddress,
+	// never block a deregistration because of the vpc checks, aws finds the
+	// target by its ip
+	params := &elbv2.DeregisterTargetsInput{
+		TargetGroupArn: targetGroup.TargetGroupArn,
+		Targets:        []*elbv2.TargetDescription{{Id: IPAddress}},
 	}
 
-	params := &elbv2.DeregisterTargetsInput{
-		TargetGroupArn: targetGroups[*targetGroupName],
-		Targets:        []*elbv2.TargetDescription{target},
+	if p.dryRun != nil {
+		p.dryRun.Record(dryrun.ActionDeregister, *targetGroupName, *IPAddress, "")
+		return nil
 	}
 
 	// TODO: should add context and retry for aws request.
 	// should use DeregisterTargetsWithContext
 	if _, err := p.client.DeregisterTargets(params); err != nil {
-		return utils.AWSDeregisterError{
-			Err: err,
-			TargetGroupARN: *targetGroups[*targetGroupName],
-		}
+		return wrapError("DeregisterTargets", *targetGroupName, aws.StringValue(targetGroup.TargetGroupArn), err)
 	}
 
 	return nil
@@ -1,20 +1,33 @@
 package provider
 
 import (
+	"errors"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/elbv2"
 	"github.com/patrickmn/go-cache"
 	"github.com/stretchr/testify/assert"
+	"github.com/zduymz/elb-inject/pkg/dryrun"
 	"github.com/zduymz/elb-inject/pkg/utils"
 
 	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 //TODO: write more test cases
-type mockSession struct{}
+type mockSession struct {
+	mu sync.Mutex
+	// arn -> tags added by AddTags
+	added   map[string][]*elbv2.Tag
+	addTags int
+}
 
 func (s *mockSession) DescribeTargetGroups(_ *elbv2.DescribeTargetGroupsInput) (*elbv2.DescribeTargetGroupsOutput, error) {
 	// should return different result depend on input
@@ -58,6 +71,7 @@ func (s *mockSession) DescribeTargetGroups(_ *elbv2.DescribeTargetGroupsInput) (
 				Protocol:                aws.String("HTTPS"),
 				TargetGroupArn:          aws.String("arn:aws:elasticloadbalancing:us-west-2:123456789012:targetgroup/devops-graylog-fluent/167d61f098a726ce"),
 				TargetGroupName:         aws.String("dmai-test-1"),
+				IpAddressType:           aws.String("ipv6"),
 				TargetType:              aws.String("ip"),
 				UnhealthyThresholdCount: aws.Int64(2),
 				VpcId:                   aws.String("vpc-c78fffa0"),
@@ -102,6 +116,26 @@ func (s *mockSession) DescribeTargetGroups(_ *elbv2.DescribeTargetGroupsInput) (
 				UnhealthyThresholdCount: aws.Int64(3),
 				VpcId:                   aws.String("vpc-9931a0fc"),
 			},
+			//---------
+			{
+				HealthCheckEnabled:         aws.Bool(true),
+				HealthCheckIntervalSeconds: aws.Int64(30),
+				HealthCheckPath:            aws.String("/"),
+				HealthCheckPort:            aws.String("traffic-port"),
+				HealthCheckProtocol:        aws.String("HTTP"),
+				HealthCheckTimeoutSeconds:  aws.Int64(5),
+				HealthyThresholdCount:      aws.Int64(5),
+				Matcher: &elbv2.Matcher{
+					HttpCode: aws.String("200"),
+				},
+				Port:                    aws.Int64(80),
+				Protocol:                aws.String("HTTP"),
+				TargetGroupArn:          aws.String("arn:aws:elasticloadbalancing:us-west-2:123456789012:targetgroup/dmai-test-4/0d2b2c1f5e3a4b6c"),
+				TargetGroupName:         aws.String("dmai-test-4"),
+				TargetType:              aws.String("instance"),
+				UnhealthyThresholdCount: aws.Int64(3),
+				VpcId:                   aws.String("vpc-9931a0fc"),
+			},
 		},
 	}
 	return output, nil
@@ -125,10 +159,7 @@ func (s *mockSession) DeregisterTargets(input *elbv2.DeregisterTargetsInput) (*e
 	randomErrors := []error{
 		fmt.Errorf(elbv2.ErrCodeTargetGroupNotFoundException),
 		fmt.Errorf(elbv2.ErrCodeInvalidTargetException),
-		utils.AWSDeregisterError{
-			TargetGroupARN: "fake-target-group",
-			Err:            fmt.Errorf(elbv2.ErrCodeInvalidTargetException),
-		},
+		awserr.New(elbv2.ErrCodeInvalidTargetException, "invalid target", nil),
 	}
 	rand.Seed(time.Now().Unix())
 	if *input.TargetGroupArn == "please-return-error" {
@@ -139,12 +170,106 @@ func (s *mockSession) DeregisterTargets(input *elbv2.DeregisterTargetsInput) (*e
 	return nil, nil
 }
 
+func (s *mockSession) DescribeTargetGroupAttributes(input *elbv2.DescribeTargetGroupAttributesInput) (*elbv2.DescribeTargetGroupAttributesOutput, error) {
+	if *input.TargetGroupArn == "please-return-error" {
+		return nil, fmt.Errorf(elbv2.ErrCodeTargetGroupNotFoundException)
+	}
+
+	return &elbv2.DescribeTargetGroupAttributesOutput{
+		Attributes: []*elbv2.TargetGroupAttribute{
+			{Key: aws.String("stickiness.enabled"), Value: aws.String("false")},
+			{Key: aws.String("deregistration_delay.timeout_seconds"), Value: aws.String("45")},
+		},
+	}, nil
+}
+
+type mockEC2Session struct {
+	describeSubnets int
+}
+
+func (s *mockEC2Session) DescribeSubnets(input *ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error) {
+	s.describeSubnets++
+	subnets := map[string][]*ec2.Subnet{
+		"vpc-c78fffa0": {
+			{CidrBlock: aws.String("10.0.0.0/24"), VpcId: aws.String("vpc-c78fffa0")},
+			{
+				CidrBlock: aws.String("10.0.1.0/24"),
+				VpcId:     aws.String("vpc-c78fffa0"),
+				Ipv6CidrBlockAssociationSet: []*ec2.SubnetIpv6CidrBlockAssociation{
+					{Ipv6CidrBlock: aws.String("2600:1f14:abc:de00::/64")},
+				},
+			},
+		},
+		"vpc-9931a0fc": {
+			{CidrBlock: aws.String("172.31.0.0/20"), VpcId: aws.String("vpc-9931a0fc")},
+		},
+	}
+
+	return &ec2.DescribeSubnetsOutput{Subnets: subnets[*input.Filters[0].Values[0]]}, nil
+}
+
+func (s *mockSession) DescribeTargetHealth(input *elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error) {
+	if *input.TargetGroupArn == "please-return-error" {
+		return nil, fmt.Errorf(elbv2.ErrCodeTargetGroupNotFoundException)
+	}
+
+	return &elbv2.DescribeTargetHealthOutput{
+		TargetHealthDescriptions: []*elbv2.TargetHealthDescription{
+			{
+				Target:       &elbv2.TargetDescription{Id: aws.String("10.0.0.10"), Port: aws.Int64(443)},
+				TargetHealth: &elbv2.TargetHealth{State: aws.String(elbv2.TargetHealthStateEnumHealthy)},
+			},
+			{
+				Target: &elbv2.TargetDescription{Id: aws.String("10.0.0.11"), Port: aws.Int64(443)},
+				TargetHealth: &elbv2.TargetHealth{
+					State:  aws.String(elbv2.TargetHealthStateEnumUnhealthy),
+					Reason: aws.String(elbv2.TargetHealthReasonEnumTargetFailedHealthChecks),
+				},
+			},
+		},
+	}, nil
+}
+
+func (s *mockSession) DescribeTags(input *elbv2.DescribeTagsInput) (*elbv2.DescribeTagsOutput, error) {
+	output := &elbv2.DescribeTagsOutput{}
+	for _, arn := range input.ResourceArns {
+		description := &elbv2.TagDescription{ResourceArn: arn}
+		if strings.Contains(*arn, "devops-graylog") {
+			description.Tags = []*elbv2.Tag{
+				{Key: aws.String("elb-inject/managed"), Value: aws.String("true")},
+				{Key: aws.String(ClusterTagKey), Value: aws.String("prod")},
+			}
+		}
+		s.mu.Lock()
+		description.Tags = append(description.Tags, s.added[*arn]...)
+		s.mu.Unlock()
+		output.TagDescriptions = append(output.TagDescriptions, description)
+	}
+	return output, nil
+}
+
+func (s *mockSession) AddTags(input *elbv2.AddTagsInput) (*elbv2.AddTagsOutput, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.addTags++
+	if s.added == nil {
+		s.added = make(map[string][]*elbv2.Tag)
+	}
+	for _, arn := range input.ResourceArns {
+		s.added[*arn] = append(s.added[*arn], input.Tags...)
+	}
+	return &elbv2.AddTagsOutput{}, nil
+}
+
 func NewMockAWSProvider() *AWSProvider {
 	provider := &AWSProvider{
 		client: &mockSession{},
-		dryRun: false,
+		ec2Client: &mockEC2Session{},
+		dryRun: nil,
 		cachePool: cache.New(1*time.Minute, 1*time.Minute),
 	}
+	provider.initTargetGroupCache()
 
 	return provider
 }
@@ -165,11 +290,21 @@ func TestGetTargetGroups(t *testing.T) {
 
 func TestRegister(t *testing.T) {
 	provider := NewMockAWSProvider()
-	err := provider.RegisterIPToTargetGroup(aws.String("dmai-test-2"), aws.String("1.1.1.1"))
+	err := provider.RegisterIPToTargetGroup(aws.String("dmai-test-2"), aws.String("172.31.0.10"))
 	assert.NotEqual(t, err, nil)
 
-	err = provider.RegisterIPToTargetGroup(aws.String("dmai-test-0"), aws.String("1.1.1.1"))
+	err = provider.RegisterIPToTargetGroup(aws.String("dmai-test-0"), aws.String("10.0.0.10"))
 	assert.Equal(t, err, nil)
+
+	err = provider.RegisterIPToTargetGroup(aws.String("dmai-test-0"), aws.String("1.1.1.1"))
+	assert.IsType(t, utils.TargetIPOutsideVPC{}, err)
+
+	// never recorded as registered
+	err = provider.RegisterIPToTargetGroup(aws.String("dmai-test-404"), aws.String("10.0.0.10"))
+	assert.IsType(t, utils.TargetGroupNotFound{}, err)
+
+	err = provider.RegisterIPToTargetGroup(aws.String("dmai-test-4"), aws.String("10.0.0.10"))
+	assert.IsType(t, utils.TargetGroupNotIPType{}, err)
 }
 
 func TestDeregister(t *testing.T) {
@@ -179,4 +314,237 @@ func TestDeregister(t *testing.T) {
 
 	err = provider.DeregisterIPFromTargetGroup(aws.String("dmai-test-2"), aws.String("1.1.1.2"))
 	assert.NotEqual(t, err, nil)
-}
\ No newline at end of file
+
+	// never blocked by the vpc checks, nor waits for the subnets
+	provider.vpcID = "vpc-c78fffa0"
+	err = provider.DeregisterIPFromTargetGroup(aws.String("dmai-test-3"), aws.String("8.8.8.8"))
+	assert.Equal(t, err, nil)
+	assert.Equal(t, 0, provider.ec2Client.(*mockEC2Session).describeSubnets)
+}
+
+func TestDryRun(t *testing.T) {
+	provider := NewMockAWSProvider()
+	provider.dryRun = dryrun.NewRecorder()
+
+	// the mock fails these, dry-run never calls it
+	assert.Nil(t, provider.RegisterIPToTargetGroup(aws.String("dmai-test-2"), aws.String("172.31.0.10")))
+	assert.Nil(t, provider.DeregisterIPFromTargetGroup(aws.String("dmai-test-2"), aws.String("1.1.1.2")))
+
+	// checks still run
+	provider.vpcID = "vpc-c78fffa0"
+	err := provider.RegisterIPToTargetGroup(aws.String("dmai-test-0"), aws.String("1.1.1.1"))
+	assert.IsType(t, utils.TargetIPOutsideVPC{}, err)
+
+	summary := provider.dryRun.Summary()
+	assert.Equal(t, 1, summary.Counts[dryrun.ActionRegister])
+	assert.Equal(t, 1, summary.Counts[dryrun.ActionDeregister])
+	assert.Equal(t, "dmai-test-2", summary.Recent[0].TargetGroup)
+}
+
+func TestValidateTargetGroup(t *testing.T) {
+	provider := NewMockAWSProvider()
+	assert.Equal(t, nil, provider.ValidateTargetGroup("dmai-test-3"))
+
+	provider.vpcID = "vpc-c78fffa0"
+	assert.Equal(t, nil, provider.ValidateTargetGroup("dmai-test-0"))
+
+	err := provider.ValidateTargetGroup("dmai-test-404")
+	assert.IsType(t, utils.TargetGroupNotFound{}, err)
+
+	err = provider.ValidateTargetGroup("dmai-test-4")
+	assert.IsType(t, utils.TargetGroupNotIPType{}, err)
+
+	err = provider.ValidateTargetGroup("dmai-test-3")
+	assert.IsType(t, utils.TargetGroupVPCMismatch{}, err)
+}
+
+func TestTargetDescription(t *testing.T) {
+	provider := NewMockAWSProvider()
+	provider.vpcID = "vpc-c78fffa0"
+	targetGroups, _ := provider.describeTargetGroups()
+
+	target, err := provider.targetDescription(targetGroups["dmai-test-0"], "10.0.1.5")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, (*string)(nil), target.AvailabilityZone)
+
+	target, err = provider.targetDescription(targetGroups["dmai-test-0"], "2600:1f14:abc:de00::10")
+	assert.Equal(t, nil, err)
+
+	_, err = provider.targetDescription(targetGroups["dmai-test-3"], "172.31.0.5")
+	assert.IsType(t, utils.TargetGroupVPCMismatch{}, err)
+
+	_, err = provider.targetDescription(targetGroups["dmai-test-0"], "192.168.0.5")
+	assert.IsType(t, utils.TargetIPOutsideVPC{}, err)
+
+	provider.allowOutsideVPC = true
+	target, err = provider.targetDescription(targetGroups["dmai-test-0"], "192.168.0.5")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "all", *target.AvailabilityZone)
+
+	_, err = provider.targetDescription(targetGroups["dmai-test-0"], "8.8.8.8")
+	assert.IsType(t, utils.TargetIPOutsideVPC{}, err)
+}
+
+func TestGetDeregistrationDelay(t *testing.T) {
+	provider := NewMockAWSProvider()
+	delay, err := provider.GetDeregistrationDelay("dmai-test-0")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, int64(45), delay)
+
+	_, err = provider.GetDeregistrationDelay("dmai-test-2")
+	assert.NotEqual(t, nil, err)
+
+	_, err = provider.GetDeregistrationDelay("dmai-test-404")
+	assert.IsType(t, utils.TargetGroupNotFound{}, err)
+}
+
+func TestGetIPAddressType(t *testing.T) {
+	provider := NewMockAWSProvider()
+	ipAddressType, err := provider.GetIPAddressType("dmai-test-0")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "ipv4", ipAddressType)
+
+	ipAddressType, err = provider.GetIPAddressType("dmai-test-1")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "ipv6", ipAddressType)
+
+	_, err = provider.GetIPAddressType("dmai-test-4")
+	assert.IsType(t, utils.TargetGroupNotFound{}, err)
+}
+
+func TestGetTargetGroupsByTag(t *testing.T) {
+	provider := NewMockAWSProvider()
+	names, err := provider.GetTargetGroupsByTag("elb-inject/managed", "true")
+	assert.Equal(t, nil, err)
+	sort.Strings(names)
+	assert.Equal(t, []string{"dmai-test-0", "dmai-test-1"}, names)
+
+	names, _ = provider.GetTargetGroupsByTag("elb-inject/managed", "false")
+	assert.Equal(t, 0, len(names))
+}
+
+func TestDescribeTargets(t *testing.T) {
+	provider := NewMockAWSProvider()
+	targets, err := provider.DescribeTargets("dmai-test-0")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 2, len(targets))
+
+	_, err = provider.DescribeTargets("dmai-test-2")
+	assert.NotEqual(t, nil, err)
+}
+
+func TestCheckOwnership(t *testing.T) {
+	provider := NewMockAWSProvider()
+	targetGroups, _ := provider.describeTargetGroups()
+
+	// no cluster name, no check
+	assert.Equal(t, nil, provider.checkOwnership(targetGroups["dmai-test-3"], true))
+
+	provider.clusterName = "prod"
+	assert.Equal(t, nil, provider.checkOwnership(targetGroups["dmai-test-0"], true))
+	assert.IsType(t, utils.TargetGroupNotClaimed{}, provider.checkOwnership(targetGroups["dmai-test-3"], true))
+
+	provider.claimTargetGroups = true
+	assert.Equal(t, nil, provider.checkOwnership(targetGroups["dmai-test-3"], false))
+	assert.Equal(t, nil, provider.checkOwnership(targetGroups["dmai-test-3"], true))
+
+	provider.clusterName = "staging"
+	assert.IsType(t, utils.TargetGroupClaimed{}, provider.checkOwnership(targetGroups["dmai-test-0"], true))
+
+	provider.allowForeign = true
+	assert.Equal(t, nil, provider.checkOwnership(targetGroups["dmai-test-0"], true))
+}
+
+func TestCheckOwnershipStaleTags(t *testing.T) {
+	provider := NewMockAWSProvider()
+	session := provider.client.(*mockSession)
+	targetGroups, _ := provider.describeTargetGroups()
+	provider.clusterName = "staging"
+	provider.claimTargetGroups = true
+
+	// cached before prod claimed dmai-test-0
+	provider.cachePool.Set("tags", map[string]map[string]string{"dmai-test-0": {}}, DefaultCacheTTL)
+	assert.Equal(t, utils.TargetGroupClaimed{Name: "dmai-test-0", Cluster: "prod"}, provider.checkOwnership(targetGroups["dmai-test-0"], true))
+	assert.Equal(t, 0, session.addTags)
+
+	// claimed, read back
+	assert.Equal(t, nil, provider.checkOwnership(targetGroups["dmai-test-3"], true))
+	assert.Equal(t, 1, session.addTags)
+	owner, ok, _ := provider.describeOwner("dmai-test-3", aws.StringValue(targetGroups["dmai-test-3"].TargetGroupArn))
+	assert.True(t, ok)
+	assert.Equal(t, "staging", owner)
+}
+
+func TestClassify(t *testing.T) {
+	err := wrapError("DeregisterTargets", "dmai-test-0", "arn", awserr.New("Throttling", "Rate exceeded", nil))
+	assert.True(t, errors.Is(err, utils.ErrThrottled))
+	assert.False(t, errors.Is(err, utils.ErrNotFound))
+
+	var aerr awserr.Error
+	assert.True(t, errors.As(err, &aerr))
+	assert.Equal(t, "Throttling", aerr.Code())
+
+	var perr *utils.ProviderError
+	assert.True(t, errors.As(err, &perr))
+	assert.Equal(t, "arn", perr.TargetGroupARN)
+
+	assert.Equal(t, utils.ErrNotFound, classify(awserr.New(elbv2.ErrCodeTargetGroupNotFoundException, "", nil)))
+	assert.Equal(t, utils.ErrQuotaExceeded, classify(awserr.New(elbv2.ErrCodeTooManyTargetsException, "", nil)))
+	assert.Equal(t, utils.ErrAuthFailure, classify(awserr.New("AccessDenied", "", nil)))
+	assert.Equal(t, utils.ErrTransientNetwork, classify(awserr.New("RequestError", "", &net.OpError{Op: "dial"})))
+	assert.Equal(t, utils.ErrTransientNetwork, classify(&net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")}))
+	assert.Equal(t, utils.ErrUnknown, classify(fmt.Errorf("boom")))
+
+	assert.True(t, errors.Is(utils.TargetGroupNotFound{Name: "x"}, utils.ErrNotFound))
+	assert.True(t, errors.Is(utils.TargetIPOutsideVPC{}, utils.ErrInvalidTarget))
+}
+
+func TestTargetGroupCache(t *testing.T) {
+	var mu sync.Mutex
+	calls := 0
+	release := make(chan struct{})
+	groups := map[string]*elbv2.TargetGroup{"web": {TargetGroupName: aws.String("web")}}
+	c := newTargetGroupCache(func() (map[string]*elbv2.TargetGroup, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		<-release
+		return groups, nil
+	}, nil)
+
+	// concurrent first uses share one describe
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tg, err := c.lookup("web")
+			assert.Nil(t, err)
+			assert.NotNil(t, tg)
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, 1, calls)
+
+	// a miss right after a refresh doesn't describe again
+	tg, err := c.lookup("api")
+	assert.Nil(t, err)
+	assert.Nil(t, tg)
+	assert.Equal(t, 1, calls)
+
+	// an older cache is refreshed on a miss
+	c.updated = time.Now().Add(-time.Minute)
+	groups = map[string]*elbv2.TargetGroup{"web": groups["web"], "api": {TargetGroupName: aws.String("api")}}
+	tg, err = c.lookup("api")
+	assert.Nil(t, err)
+	assert.Equal(t, "api", aws.StringValue(tg.TargetGroupName))
+	assert.Equal(t, 2, calls)
+
+	// a failed refresh keeps the cached target groups
+	c.describe = func() (map[string]*elbv2.TargetGroup, error) { return nil, fmt.Errorf("throttled") }
+	assert.NotNil(t, c.refresh(refreshInterval))
+	tg, _ = c.lookup("web")
+	assert.NotNil(t, tg)
+}
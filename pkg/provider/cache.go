@@ -0,0 +1,143 @@
+package provider
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog"
+
+	"github.com/zduymz/elb-inject/pkg/metrics"
+)
+
+// what made the target group cache refresh
+const (
+	refreshInit     = "init"
+	refreshInterval = "interval"
+	refreshMiss     = "miss"
+)
+
+// targetGroupCache keeps every target group with its metadata (vpc, port,
+// protocol, type, load balancers) by name. A background refresher updates it,
+// a lookup of an unknown name forces a refresh. Concurrent refreshes share
+// one DescribeTargetGroups.
+type targetGroupCache struct {
+	describe func() (map[string]*elbv2.TargetGroup, error)
+	// drops what is derived from the target groups, e.g. tags
+	onRefresh func()
+
+	mu      sync.RWMutex
+	groups  map[string]*elbv2.TargetGroup
+	updated time.Time
+
+	refreshMu sync.Mutex
+	inflight  *refreshCall
+}
+
+type refreshCall struct {
+	done chan struct{}
+	err  error
+}
+
+func newTargetGroupCache(describe func() (map[string]*elbv2.TargetGroup, error), onRefresh func()) *targetGroupCache {
+	c := &targetGroupCache{describe: describe, onRefresh: onRefresh}
+	metrics.SetTargetGroupCacheAge(c.age)
+	return c
+}
+
+// get returns every target group, they are described on first use
+func (c *targetGroupCache) get() (map[string]*elbv2.TargetGroup, error) {
+	c.mu.RLock()
+	groups := c.groups
+	c.mu.RUnlock()
+	if groups != nil {
+		return groups, nil
+	}
+
+	if err := c.refresh(refreshInit); err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.groups, nil
+}
+
+// lookup returns target group name, nil when it doesn't exist. A miss
+// refreshes the cache unless it is younger than minRefreshInterval.
+func (c *targetGroupCache) lookup(name string) (*elbv2.TargetGroup, error) {
+	groups, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	if targetGroup, ok := groups[name]; ok {
+		return targetGroup, nil
+	}
+
+	if c.age() < minRefreshInterval {
+		return nil, nil
+	}
+	klog.V(4).Infof("Target group %s is not cached, refreshing", name)
+	if err := c.refresh(refreshMiss); err != nil {
+		return nil, err
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.groups[name], nil
+}
+
+// age is the time since the last successful refresh
+func (c *targetGroupCache) age() time.Duration {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.updated.IsZero() {
+		return 0
+	}
+	return time.Since(c.updated)
+}
+
+// refresh describes the target groups, a caller arriving while a refresh is
+// running waits for its result. The cached ones are kept on error.
+func (c *targetGroupCache) refresh(trigger string) error {
+	c.refreshMu.Lock()
+	if call := c.inflight; call != nil {
+		c.refreshMu.Unlock()
+		<-call.done
+		return call.err
+	}
+	call := &refreshCall{done: make(chan struct{})}
+	c.inflight = call
+	c.refreshMu.Unlock()
+
+	groups, err := c.describe()
+	if err == nil {
+		c.mu.Lock()
+		c.groups = groups
+		c.updated = time.Now()
+		c.mu.Unlock()
+		if c.onRefresh != nil {
+			c.onRefresh()
+		}
+		metrics.TargetGroupCacheRefreshes.WithLabelValues(trigger, "success").Inc()
+	} else {
+		metrics.TargetGroupCacheRefreshes.WithLabelValues(trigger, "error").Inc()
+	}
+
+	c.refreshMu.Lock()
+	c.inflight = nil
+	c.refreshMu.Unlock()
+	call.err = err
+	close(call.done)
+	return err
+}
+
+// run refreshes every interval until stopCh is closed
+func (c *targetGroupCache) run(interval time.Duration, stopCh <-chan struct{}) {
+	wait.Until(func() {
+		if err := c.refresh(refreshInterval); err != nil {
+			klog.Errorf("Can not refresh target groups, keeping the ones from %s ago: %v", c.age(), err)
+		}
+	}, interval, stopCh)
+}
@@ -0,0 +1,78 @@
+package provider
+
+import (
+	"errors"
+	"net"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+
+	"github.com/zduymz/elb-inject/pkg/utils"
+)
+
+// awserr codes -> error class, the sdk has no constants for the generic ones
+var errorClasses = map[string]error{
+	elbv2.ErrCodeTargetGroupNotFoundException:  utils.ErrNotFound,
+	elbv2.ErrCodeLoadBalancerNotFoundException: utils.ErrNotFound,
+
+	"Throttling":                utils.ErrThrottled,
+	"ThrottlingException":       utils.ErrThrottled,
+	"RequestLimitExceeded":      utils.ErrThrottled,
+	"RequestThrottled":          utils.ErrThrottled,
+	"RequestThrottledException": utils.ErrThrottled,
+	"TooManyRequestsException":  utils.ErrThrottled,
+
+	elbv2.ErrCodeInvalidTargetException: utils.ErrInvalidTarget,
+
+	elbv2.ErrCodeTooManyTargetsException:                  utils.ErrQuotaExceeded,
+	elbv2.ErrCodeTooManyRegistrationsForTargetIdException: utils.ErrQuotaExceeded,
+	elbv2.ErrCodeTooManyTagsException:                     utils.ErrQuotaExceeded,
+	"LimitExceeded":                                       utils.ErrQuotaExceeded,
+
+	"AccessDenied":                utils.ErrAuthFailure,
+	"AccessDeniedException":       utils.ErrAuthFailure,
+	"UnauthorizedOperation":       utils.ErrAuthFailure,
+	"AuthFailure":                 utils.ErrAuthFailure,
+	"ExpiredToken":                utils.ErrAuthFailure,
+	"ExpiredTokenException":       utils.ErrAuthFailure,
+	"InvalidClientTokenId":        utils.ErrAuthFailure,
+	"SignatureDoesNotMatch":       utils.ErrAuthFailure,
+	"UnrecognizedClientException": utils.ErrAuthFailure,
+	"NoCredentialProviders":       utils.ErrAuthFailure,
+
+	request.ErrCodeRequestError:    utils.ErrTransientNetwork,
+	request.ErrCodeResponseTimeout: utils.ErrTransientNetwork,
+	"RequestTimeout":               utils.ErrTransientNetwork,
+	"RequestTimeoutException":      utils.ErrTransientNetwork,
+	"ServiceUnavailable":           utils.ErrTransientNetwork,
+	"InternalFailure":              utils.ErrTransientNetwork,
+	"InternalError":                utils.ErrTransientNetwork,
+}
+
+// classify returns the utils.Err* class of an aws call error
+func classify(err error) error {
+	var aerr awserr.Error
+	if errors.As(err, &aerr) {
+		if class, ok := errorClasses[aerr.Code()]; ok {
+			return class
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return utils.ErrTransientNetwork
+	}
+	return utils.ErrUnknown
+}
+
+// wrapError turns the error of the aws call op into a *utils.ProviderError,
+// targetGroup and arn are empty when op is not about one target group
+func wrapError(op, targetGroup, arn string, err error) error {
+	return &utils.ProviderError{
+		Class:          classify(err),
+		Op:             op,
+		TargetGroup:    targetGroup,
+		TargetGroupARN: arn,
+		Err:            err,
+	}
+}
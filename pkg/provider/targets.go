@@ -0,0 +1,218 @@
+package provider
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/zduymz/elb-inject/pkg/dryrun"
+	"github.com/zduymz/elb-inject/pkg/utils"
+	"k8s.io/klog"
+)
+
+const (
+	// DescribeTags accepts at most 20 resources
+	describeTagsBatchSize = 20
+
+	// ClusterTagKey tells which cluster owns a target group
+	ClusterTagKey = "elb-inject/cluster"
+
+	// MinHealthyTargetsTagKey is the number of healthy targets a voluntary
+	// deregistration has to leave in the target group
+	MinHealthyTargetsTagKey = "elb-inject/min-healthy-targets"
+)
+
+// getTags returns tags of ip type target groups in map[Name: map[Key: Value]]
+func (p *AWSProvider) getTags() (map[string]map[string]string, error) {
+	if foo, found := p.cachePool.Get("tags"); found {
+		return foo.(map[string]map[string]string), nil
+	}
+
+	targetGroups, err := p.getTargetGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]string)
+	var arns []*string
+	for name, arn := range targetGroups {
+		names[*arn] = name
+		arns = append(arns, arn)
+	}
+
+	tags := make(map[string]map[string]string)
+	for start := 0; start < len(arns); start += describeTagsBatchSize {
+		end := start + describeTagsBatchSize
+		if end > len(arns) {
+			end = len(arns)
+		}
+
+		output, err := p.client.DescribeTags(&elbv2.DescribeTagsInput{ResourceArns: arns[start:end]})
+		if err != nil {
+			klog.Errorf("Can not describe tags: %s", err.Error())
+			return nil, wrapError("DescribeTags", "", "", err)
+		}
+
+		for _, description := range output.TagDescriptions {
+			name := names[aws.StringValue(description.ResourceArn)]
+			tags[name] = make(map[string]string)
+			for _, tag := range description.Tags {
+				tags[name][aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+			}
+		}
+	}
+
+	p.cachePool.Set("tags", tags, DefaultCacheTTL)
+	return tags, nil
+}
+
+// GetTargetGroupTags returns tags of ip type targetGroupName
+func (p *AWSProvider) GetTargetGroupTags(targetGroupName string) (map[string]string, error) {
+	tags, err := p.getTags()
+	if err != nil {
+		return nil, err
+	}
+
+	tgTags, ok := tags[targetGroupName]
+	if !ok {
+		return nil, utils.TargetGroupNotFound{Name: targetGroupName}
+	}
+	return tgTags, nil
+}
+
+// GetTargetGroupsByTag returns name of ip type target groups tagged with key=value
+func (p *AWSProvider) GetTargetGroupsByTag(key, value string) ([]string, error) {
+	tags, err := p.getTags()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name, tgTags := range tags {
+		if v, ok := tgTags[key]; ok && v == value {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// checkOwnership makes sure targetGroup belongs to our cluster. An unclaimed
+// target group is tagged with our cluster name when claim is true.
+func (p *AWSProvider) checkOwnership(targetGroup *elbv2.TargetGroup, claim bool) error {
+	if p.clusterName == "" {
+		return nil
+	}
+
+	name := aws.StringValue(targetGroup.TargetGroupName)
+	tags, err := p.getTags()
+	if err != nil {
+		return err
+	}
+
+	owner, ok := tags[name][ClusterTagKey]
+	switch {
+	case ok && owner == p.clusterName:
+		return nil
+	case ok && p.allowForeign:
+		klog.Warningf("Target group %s is claimed by cluster %s, using it anyway", name, owner)
+		return nil
+	case ok:
+		return utils.TargetGroupClaimed{Name: name, Cluster: owner}
+	case !p.claimTargetGroups:
+		return utils.TargetGroupNotClaimed{Name: name, Cluster: p.clusterName}
+	case !claim:
+		return nil
+	}
+
+	// the cached tags may be minutes old, another cluster may have claimed it meanwhile
+	arn := aws.StringValue(targetGroup.TargetGroupArn)
+	owner, ok, err = p.describeOwner(name, arn)
+	if err != nil {
+		return err
+	}
+	if ok {
+		p.cachePool.Delete("tags")
+		if owner == p.clusterName || p.allowForeign {
+			return nil
+		}
+		return utils.TargetGroupClaimed{Name: name, Cluster: owner}
+	}
+
+	if p.dryRun != nil {
+		p.dryRun.Record(dryrun.ActionClaim, name, p.clusterName, ClusterTagKey)
+		return nil
+	}
+
+	klog.Infof("Claiming target group %s for cluster %s", name, p.clusterName)
+	if _, err := p.client.AddTags(&elbv2.AddTagsInput{
+		ResourceArns: []*string{targetGroup.TargetGroupArn},
+		Tags:         []*elbv2.Tag{{Key: aws.String(ClusterTagKey), Value: aws.String(p.clusterName)}},
+	}); err != nil {
+		return wrapError("AddTags", name, arn, err)
+	}
+	p.cachePool.Delete("tags")
+
+	// AddTags overwrites, a cluster claiming at the same time may have won
+	owner, _, err = p.describeOwner(name, arn)
+	if err != nil {
+		return err
+	}
+	if owner != p.clusterName {
+		klog.Warningf("Target group %s was claimed by cluster %s at the same time", name, owner)
+		return utils.TargetGroupClaimed{Name: name, Cluster: owner}
+	}
+	return nil
+}
+
+// describeOwner reads the cluster tag of one target group, bypassing the tags cache
+func (p *AWSProvider) describeOwner(name, arn string) (string, bool, error) {
+	output, err := p.client.DescribeTags(&elbv2.DescribeTagsInput{ResourceArns: []*string{aws.String(arn)}})
+	if err != nil {
+		return "", false, wrapError("DescribeTags", name, arn, err)
+	}
+	for _, description := range output.TagDescriptions {
+		for _, tag := range description.Tags {
+			if aws.StringValue(tag.Key) == ClusterTagKey {
+				return aws.StringValue(tag.Value), true, nil
+			}
+		}
+	}
+	return "", false, nil
+}
+
+// DescribeTargets returns targets of targetGroupName with their health
+func (p *AWSProvider) DescribeTargets(targetGroupName string) ([]*elbv2.TargetHealthDescription, error) {
+	targetGroup, err := p.LookupTargetGroup(targetGroupName)
+	if err != nil {
+		return nil, err
+	}
+
+	output, err := p.client.DescribeTargetHealth(&elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: targetGroup.TargetGroupArn,
+	})
+	if err != nil {
+		return nil, wrapError("DescribeTargetHealth", targetGroupName, aws.StringValue(targetGroup.TargetGroupArn), err)
+	}
+	return output.TargetHealthDescriptions, nil
+}
+
+// DeregisterTargets removes targets as they are described by DescribeTargets
+func (p *AWSProvider) DeregisterTargets(targetGroupName string, targets []*elbv2.TargetDescription) error {
+	targetGroup, err := p.LookupTargetGroup(targetGroupName)
+	if err != nil {
+		return err
+	}
+
+	if p.dryRun != nil {
+		for _, target := range targets {
+			p.dryRun.Record(dryrun.ActionDeregister, targetGroupName, aws.StringValue(target.Id), "")
+		}
+		return nil
+	}
+
+	if _, err := p.client.DeregisterTargets(&elbv2.DeregisterTargetsInput{
+		TargetGroupArn: targetGroup.TargetGroupArn,
+		Targets:        targets,
+	}); err != nil {
+		return wrapError("DeregisterTargets", targetGroupName, aws.StringValue(targetGroup.TargetGroupArn), err)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package provider
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/zduymz/elb-inject/pkg/utils"
+	"k8s.io/klog"
+)
+
+// ip ranges aws accepts for an ip target outside of the target group vpc
+var outsideVPCRanges = []string{
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+}
+
+// discoverVPC returns vpc of the instance we are running on
+func discoverVPC(awsSession *session.Session) (string, error) {
+	metadata := ec2metadata.New(awsSession)
+	if !metadata.Available() {
+		return "", fmt.Errorf("ec2 metadata is not available")
+	}
+
+	mac, err := metadata.GetMetadata("mac")
+	if err != nil {
+		return "", err
+	}
+
+	return metadata.GetMetadata(fmt.Sprintf("network/interfaces/macs/%s/vpc-id", mac))
+}
+
+// Return cidr of all subnets in vpcID
+func (p *AWSProvider) getSubnetCIDRs(vpcID string) ([]*net.IPNet, error) {
+	cacheKey := "subnets/" + vpcID
+	if foo, found := p.cachePool.Get(cacheKey); found {
+		return foo.([]*net.IPNet), nil
+	}
+
+	var cidrs []*net.IPNet
+	input := &ec2.DescribeSubnetsInput{
+		Filters: []*ec2.Filter{
+			{Name: aws.String("vpc-id"), Values: []*string{aws.String(vpcID)}},
+		},
+	}
+
+	for {
+		output, err := p.ec2Client.DescribeSubnets(input)
+		if err != nil {
+			klog.Errorf("Can not describe subnets of %s: %s", vpcID, err.Error())
+			return nil, wrapError("DescribeSubnets", "", "", err)
+		}
+
+		for _, subnet := range output.Subnets {
+			blocks := []*string{subnet.CidrBlock}
+			for _, association := range subnet.Ipv6CidrBlockAssociationSet {
+				blocks = append(blocks, association.Ipv6CidrBlock)
+			}
+			for _, block := range blocks {
+				if block == nil {
+					continue
+				}
+				if _, cidr, err := net.ParseCIDR(*block); err == nil {
+					cidrs = append(cidrs, cidr)
+				}
+			}
+		}
+
+		if output.NextToken == nil {
+			break
+		}
+		input.NextToken = output.NextToken
+	}
+
+	klog.V(4).Infof("Subnets of %s: %v", vpcID, cidrs)
+	p.cachePool.Set(cacheKey, cidrs, DefaultCacheTTL)
+	return cidrs, nil
+}
+
+// targetDescription checks ipAddress can be registered to targetGroup.
+// An ip outside of the vpc subnets is only allowed with allowOutsideVPC and
+// gets AvailabilityZone all.
+func (p *AWSProvider) targetDescription(targetGroup *elbv2.TargetGroup, ipAddress string) (*elbv2.TargetDescription, error) {
+	targetGroupName := aws.StringValue(targetGroup.TargetGroupName)
+	targetGroupVPC := aws.StringValue(targetGroup.VpcId)
+
+	if p.vpcID != "" && targetGroupVPC != p.vpcID {
+		return nil, utils.TargetGroupVPCMismatch{Name: targetGroupName, VpcId: targetGroupVPC, ExpectedVpcId: p.vpcID}
+	}
+
+	ip := net.ParseIP(ipAddress)
+	if ip == nil {
+		return nil, utils.InvalidIPAddress{IP: ipAddress}
+	}
+
+	target := &elbv2.TargetDescription{Id: aws.String(ipAddress)}
+
+	cidrs, err := p.getSubnetCIDRs(targetGroupVPC)
+	if err != nil {
+		return nil, err
+	}
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return target, nil
+		}
+	}
+
+	if !p.allowOutsideVPC || !inRanges(ip, outsideVPCRanges) {
+		return nil, utils.TargetIPOutsideVPC{IP: ipAddress, TargetGroupName: targetGroupName, VpcId: targetGroupVPC}
+	}
+
+	target.AvailabilityZone = aws.String("all")
+	return target, nil
+}
+
+func inRanges(ip net.IP, ranges []string) bool {
+	for _, r := range ranges {
+		_, cidr, err := net.ParseCIDR(r)
+		if err == nil && cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
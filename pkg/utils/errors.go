@@ -1,6 +1,9 @@
 package utils
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+)
 
 type PodNotRun struct {}
 
@@ -8,11 +11,139 @@ func (p PodNotRun) Error() string {
 	return fmt.Sprintf("Pod not running")
 }
 
-type AWSDeregisterError struct {
+type TargetGroupNotFound struct {
+	Name string
+}
+
+func (t TargetGroupNotFound) Error() string {
+	return fmt.Sprintf("target group %s is not found", t.Name)
+}
+
+func (t TargetGroupNotFound) Is(target error) bool {
+	return target == ErrNotFound
+}
+
+type TargetGroupNotIPType struct {
+	Name       string
+	TargetType string
+}
+
+func (t TargetGroupNotIPType) Error() string {
+	return fmt.Sprintf("target group %s has target type %s, only ip is supported", t.Name, t.TargetType)
+}
+
+func (t TargetGroupNotIPType) Is(target error) bool {
+	return target == ErrInvalidTarget
+}
+
+type TargetGroupVPCMismatch struct {
+	Name          string
+	VpcId         string
+	ExpectedVpcId string
+}
+
+func (t TargetGroupVPCMismatch) Error() string {
+	return fmt.Sprintf("target group %s is in %s, cluster is in %s", t.Name, t.VpcId, t.ExpectedVpcId)
+}
+
+func (t TargetGroupVPCMismatch) Is(target error) bool {
+	return target == ErrInvalidTarget
+}
+
+type InvalidIPAddress struct {
+	IP string
+}
+
+func (i InvalidIPAddress) Error() string {
+	return fmt.Sprintf("invalid ip address: %s", i.IP)
+}
+
+func (i InvalidIPAddress) Is(target error) bool {
+	return target == ErrInvalidTarget
+}
+
+type TargetIPOutsideVPC struct {
+	IP              string
+	TargetGroupName string
+	VpcId           string
+}
+
+func (t TargetIPOutsideVPC) Error() string {
+	return fmt.Sprintf("ip %s is outside of the subnets of %s (target group %s)", t.IP, t.VpcId, t.TargetGroupName)
+}
+
+func (t TargetIPOutsideVPC) Is(target error) bool {
+	return target == ErrInvalidTarget
+}
+
+type TargetGroupClaimed struct {
+	Name    string
+	Cluster string
+}
+
+func (t TargetGroupClaimed) Error() string {
+	return fmt.Sprintf("target group %s is claimed by cluster %s", t.Name, t.Cluster)
+}
+
+func (t TargetGroupClaimed) Is(target error) bool {
+	return target == ErrInvalidTarget
+}
+
+type TargetGroupNotClaimed struct {
+	Name    string
+	Cluster string
+}
+
+func (t TargetGroupNotClaimed) Error() string {
+	return fmt.Sprintf("target group %s is not claimed by cluster %s", t.Name, t.Cluster)
+}
+
+func (t TargetGroupNotClaimed) Is(target error) bool {
+	return target == ErrInvalidTarget
+}
+
+// Classes of provider errors, check them with errors.Is
+var (
+	// the target group or load balancer doesn't exist (anymore)
+	ErrNotFound = errors.New("not found")
+	// aws rate limit, retry later
+	ErrThrottled = errors.New("throttled")
+	// the target can't be registered, e.g. an ip outside of the vpc, or the
+	// target group can't be used by this cluster
+	ErrInvalidTarget = errors.New("invalid target")
+	// too many targets or registrations
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// missing iam permission or expired credentials
+	ErrAuthFailure = errors.New("auth failure")
+	// timeout, connection reset, aws 5xx
+	ErrTransientNetwork = errors.New("transient network error")
+	// everything else
+	ErrUnknown = errors.New("unknown error")
+)
+
+// ProviderError is a failed aws call, errors.Is matches its Class and
+// errors.As reaches the awserr.Error it wraps
+type ProviderError struct {
+	// one of the Err* classes
+	Class error
+	// aws api call, e.g. DeregisterTargets
+	Op             string
+	TargetGroup    string
 	TargetGroupARN string
-	Err error
+	Err            error
+}
+
+func (p *ProviderError) Error() string {
+	if p.TargetGroup == "" {
+		return fmt.Sprintf("%s: %v", p.Op, p.Err)
+	}
+	return fmt.Sprintf("%s %s: %v", p.Op, p.TargetGroup, p.Err)
 }
 
-func (a AWSDeregisterError) Error() string {
-	return a.Err.Error()
-}
\ No newline at end of file
+func (p *ProviderError) Unwrap() error {
+	return p.Err
+}
+
+func (p *ProviderError) Is(target error) bool {
+	return target == p.Class
+}
@@ -1,43 +0,0 @@
-package utils
-
-import (
-	"bytes"
-	"encoding/json"
-	"errors"
-	"net/http"
-	"time"
-)
-
-type SlackRequestBody struct {
-	Text string `json:"text"`
-}
-
-type Slack struct{
-	WebHookUrl string
-}
-
-func (s *Slack) SendSlackNotification(msg string) error {
-	slackBody, _ := json.Marshal(SlackRequestBody{Text: msg})
-	req, err := http.NewRequest(http.MethodPost, s.WebHookUrl, bytes.NewBuffer(slackBody))
-	if err != nil {
-		return err
-	}
-
-	req.Header.Add("Content-Type", "application/json")
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-
-	buf := new(bytes.Buffer)
-	_, err = buf.ReadFrom(resp.Body)
-	if err != nil {
-		return err
-	}
-	if buf.String() != "ok" {
-		return errors.New("Non-ok response returned from Slack")
-	}
-	return nil
-}